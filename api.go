@@ -0,0 +1,273 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+/******************************************************************************
+ * JSON API
+ * Everything under /api/v1. Successful responses carry their payload in
+ * "data", lists also the cursor for the next page in "next". Errors carry
+ * {"error": {"status": <code>, "message": <text>}} with the same status code
+ * as the response. Ids are the hashed ids also used in html links.
+ */
+
+const apiMaxPerPage = 100
+
+type apiFeed struct {
+	Handle      string     `json:"handle"`
+	Title       string     `json:"title"`
+	Link        string     `json:"link"`
+	URL         string     `json:"url"`
+	ImageURL    string     `json:"image_url,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Failures    int        `json:"failures"`
+	Disabled    bool       `json:"disabled"`
+}
+
+type apiPost struct {
+	ID    string    `json:"id"`
+	Title string    `json:"title"`
+	Link  string    `json:"link"`
+	Feed  string    `json:"feed"`
+	Date  time.Time `json:"date"`
+}
+
+type apiArticle struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+type apiRequest struct {
+	URL    string    `json:"url"`
+	Count  int       `json:"count"`
+	Date   time.Time `json:"date"`
+	Status string    `json:"status"`
+	Handle string    `json:"handle,omitempty"`
+}
+
+func newAPIFeed(feed *Feed) *apiFeed {
+	res := &apiFeed{
+		Handle:   feed.Handle,
+		Title:    feed.Title,
+		Link:     feed.Link,
+		URL:      feed.URL,
+		ImageURL: feed.ImageURL,
+		Failures: feed.Failures,
+		Disabled: feed.Disabled,
+	}
+	if !feed.LastSuccess.IsZero() {
+		t := feed.LastSuccess
+		res.LastSuccess = &t
+	}
+	return res
+}
+
+func newAPIPost(post *Post, feeds map[int64]*Feed) *apiPost {
+	res := &apiPost{
+		ID:    HashID(post.ID),
+		Title: post.Title,
+		Link:  post.Link,
+		Date:  post.Date,
+	}
+	if feed, ok := feeds[post.Feed]; ok {
+		res.Feed = feed.Handle
+	}
+	return res
+}
+
+func apiError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"status": status, "message": message}})
+}
+
+// apiPostParam resolves the :id parameter to a post, it answers the request
+// itself if that fails.
+func apiPostParam(c *gin.Context) (*Post, bool) {
+	post, err := store.PostGet(UnhashID(c.Param("id")))
+	if err == db.ErrNotFound {
+		apiError(c, http.StatusNotFound, "no such post")
+		return nil, false
+	} else if err != nil {
+		apiError(c, http.StatusInternalServerError, "internal error")
+		return nil, false
+	}
+	return post, true
+}
+
+// apiPosts lists posts of the given feeds, all feeds if handles is nil.
+func apiPosts(c *gin.Context, handles []string) {
+	n := *servePerPage
+	if s := c.Query("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > apiMaxPerPage {
+			apiError(c, http.StatusBadRequest, "n must be between 1 and "+strconv.Itoa(apiMaxPerPage))
+			return
+		}
+	}
+	before := MakeIDRaw(time.Now(), 0, 0)
+	if after := c.Query("after"); after != "" {
+		if before = UnhashID(after); before < 0 {
+			apiError(c, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	feeds, err := store.FeedAll()
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "internal error")
+		return
+	}
+	var selected []int64
+	if handles != nil {
+		lookup := make(map[string]*Feed)
+		for _, feed := range feeds {
+			lookup[feed.Handle] = feed
+		}
+		selected = make([]int64, 0)
+		for _, handle := range handles {
+			feed, ok := lookup[handle]
+			if !ok {
+				apiError(c, http.StatusNotFound, "no such feed: "+handle)
+				return
+			}
+			selected = append(selected, feed.ID)
+		}
+	}
+
+	posts, err := store.PostPage(n, before, selected)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "internal error")
+		return
+	}
+	feedMap := feedsByID(feeds)
+	data := make([]*apiPost, 0, len(posts))
+	for _, post := range posts {
+		data = append(data, newAPIPost(post, feedMap))
+	}
+	res := gin.H{"data": data}
+	if len(posts) == n {
+		res["next"] = HashID(posts[len(posts)-1].ID)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func registerAPI(api *gin.RouterGroup) {
+	api.GET("/feeds", func(c *gin.Context) {
+		feeds, err := store.FeedAll()
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "internal error")
+			return
+		}
+		data := make([]*apiFeed, 0, len(feeds))
+		for _, feed := range feeds {
+			data = append(data, newAPIFeed(feed))
+		}
+		c.JSON(http.StatusOK, gin.H{"data": data})
+	})
+
+	// :feeds is one or more handles joined by +, as in /f/:feeds
+	api.GET("/feeds/:feeds/posts", func(c *gin.Context) {
+		apiPosts(c, strings.Split(c.Param("feeds"), "+"))
+	})
+
+	api.GET("/posts", func(c *gin.Context) {
+		apiPosts(c, nil)
+	})
+
+	api.GET("/posts/:id", func(c *gin.Context) {
+		post, ok := apiPostParam(c)
+		if !ok {
+			return
+		}
+		feeds, err := store.FeedAll()
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "internal error")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": newAPIPost(post, feedsByID(feeds))})
+	})
+
+	api.GET("/posts/:id/article", func(c *gin.Context) {
+		post, ok := apiPostParam(c)
+		if !ok {
+			return
+		}
+		r, err := articles.Get(post)
+		if err != nil {
+			apiError(c, http.StatusBadGateway, "unable to fetch article: "+err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": &apiArticle{HashID(post.ID), r.URL, r.Title, r.Content}})
+	})
+
+	api.GET("/requests", func(c *gin.Context) {
+		requests, err := store.RequestAll()
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "internal error")
+			return
+		}
+		data := make([]*apiRequest, 0, len(requests))
+		for _, req := range requests {
+			if req.Status == db.RequestBanned {
+				continue
+			}
+			status := req.Status
+			if req.Pending() {
+				status = "pending"
+			}
+			data = append(data, &apiRequest{req.URL, req.N, req.Date, status, req.Handle})
+		}
+		c.JSON(http.StatusOK, gin.H{"data": data})
+	})
+
+	api.POST("/requests", func(c *gin.Context) {
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			apiError(c, http.StatusBadRequest, "expected {\"url\": <feed url>}")
+			return
+		}
+		reqURL := strings.TrimSpace(body.URL)
+		if !ValidateURL(reqURL) {
+			apiError(c, http.StatusBadRequest, "malformed feed request url")
+			return
+		}
+		feeds, err := store.FeedAll()
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, "internal error")
+			return
+		}
+		for _, feed := range feeds {
+			if feed.URL == reqURL {
+				apiError(c, http.StatusConflict, "feed already exists as "+feed.Handle)
+				return
+			}
+		}
+		err = store.RequestAdd(MakeID(), reqURL)
+		switch err {
+		case nil:
+			break
+		case db.ErrBanned:
+			apiError(c, http.StatusForbidden, err.Error())
+			return
+		case db.ErrRequestLimit:
+			apiError(c, http.StatusServiceUnavailable, err.Error())
+			return
+		default:
+			logger.Printf("ERROR: adding feed request: %s", err.Error())
+			apiError(c, http.StatusInternalServerError, "internal error")
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": gin.H{"url": reqURL}})
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	clist "container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+
+	"github.com/alexander-matz/go-news/db"
+	"github.com/alexander-matz/go-news/readability"
+)
+
+// Readability is the readable version of an article, ID is the id of the
+// post linking to it and Meta what the article page says about itself.
+type Readability struct {
+	ID      int64
+	URL     string
+	Title   string
+	Content string
+	Meta    readability.Metadata
+}
+
+// articleTimeout bounds downloading a single article.
+const articleTimeout = 30 * time.Second
+
+// Articles extracts the readable content of the articles posts link to. The
+// content is persisted with the post, the most recently used articles are
+// additionally kept in memory.
+type Articles struct {
+	store  Storage
+	log    *log.Logger
+	client *http.Client
+
+	// readLRU holds the cached articles, most recently used first, inflight
+	// the extractions in progress by url
+	readMap  map[string]*clist.Element
+	readLRU  *clist.List
+	readHold int
+	inflight map[string]*articleCall
+	lock     sync.Mutex
+}
+
+// articleCall is an extraction in progress, everyone asking for the same url
+// in the meantime waits for it instead of fetching the article again.
+type articleCall struct {
+	done chan bool
+	post *Post
+	err  error
+}
+
+func NewArticles(store Storage, log *log.Logger) *Articles {
+	a := &Articles{}
+	a.store = store
+	a.log = log
+	a.client = &http.Client{Timeout: articleTimeout}
+	a.readMap = make(map[string]*clist.Element)
+	a.readLRU = clist.New()
+	a.inflight = make(map[string]*articleCall)
+	a.readHold = 128
+	return a
+}
+
+// lookup returns the cached article at url and marks it as used.
+func (a *Articles) lookup(url string) (*Readability, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	e, ok := a.readMap[url]
+	if !ok {
+		return nil, false
+	}
+	a.readLRU.MoveToFront(e)
+	return e.Value.(*Readability), true
+}
+
+// remember caches r, evicting the least recently used article if the cache
+// is full.
+func (a *Articles) remember(r *Readability) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if e, ok := a.readMap[r.URL]; ok {
+		e.Value = r
+		a.readLRU.MoveToFront(e)
+		return
+	}
+	a.readMap[r.URL] = a.readLRU.PushFront(r)
+	for a.readLRU.Len() > a.readHold {
+		e := a.readLRU.Back()
+		a.readLRU.Remove(e)
+		delete(a.readMap, e.Value.(*Readability).URL)
+	}
+}
+
+// Forget drops the cached articles of posts with an id below before, after
+// the posts were trimmed.
+func (a *Articles) Forget(before int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for e := a.readLRU.Front(); e != nil; {
+		next := e.Next()
+		if r := e.Value.(*Readability); r.ID < before {
+			a.readLRU.Remove(e)
+			delete(a.readMap, r.URL)
+		}
+		e = next
+	}
+}
+
+func (a *Articles) fetch(url string) (string, *readability.Metadata, error) {
+	res, err := a.client.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	html, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	doc, err := readability.NewDocument(string(html))
+	if err != nil {
+		return "", nil, err
+	}
+	meta := doc.Metadata()
+	// lead images are often given relative to the page
+	if meta.Image != "" {
+		if image, err := res.Request.URL.Parse(meta.Image); err == nil && isWebURL(image) {
+			meta.Image = image.String()
+		} else {
+			meta.Image = ""
+		}
+	}
+	return readability.Sanitize(doc.Content(), res.Request.URL), meta, nil
+}
+
+func isWebURL(u *neturl.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// CacheSize returns the number of articles kept in memory.
+func (a *Articles) CacheSize() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.readMap)
+}
+
+// Get returns the readable version of the article a post links to. It is
+// looked up in memory, then in the store and only fetched if neither has it.
+func (a *Articles) Get(p *Post) (*Readability, error) {
+	if r, ok := a.lookup(p.Link); ok {
+		res := *r
+		return &res, nil
+	}
+
+	post, err := a.load(p)
+	if err != nil {
+		return nil, err
+	}
+	r := a.readable(post)
+	a.remember(r)
+	res := *r
+	return &res, nil
+}
+
+// Stored is Get for articles that were extracted before, it never fetches
+// anything and returns db.ErrNoContent for articles not extracted yet.
+func (a *Articles) Stored(p *Post) (*Readability, error) {
+	if r, ok := a.lookup(p.Link); ok {
+		res := *r
+		return &res, nil
+	}
+	post, err := a.storedContent(p)
+	if err != nil {
+		return nil, err
+	}
+	return a.readable(post), nil
+}
+
+// readable turns a post carrying its content into its readable version.
+func (a *Articles) readable(post *Post) *Readability {
+	r := &Readability{ID: post.ID, URL: post.Link, Title: post.Title, Content: post.Content}
+	if post.Meta != "" {
+		if err := json.Unmarshal([]byte(post.Meta), &r.Meta); err != nil {
+			a.log.Printf("WARNING: invalid metadata of %s: %s", HashID(post.ID), err.Error())
+		}
+	}
+	return r
+}
+
+// Prefetch makes sure the article of a post is extracted and stored, without
+// caching it in memory.
+func (a *Articles) Prefetch(p *Post) error {
+	_, err := a.load(p)
+	return err
+}
+
+// load returns a copy of p with the content of its article. Concurrent loads
+// of the same url share a single extraction, whose result is only stored
+// with the post that started it.
+func (a *Articles) load(p *Post) (*Post, error) {
+	a.lock.Lock()
+	call, ok := a.inflight[p.Link]
+	if ok {
+		a.lock.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		post := *p
+		post.Content = call.post.Content
+		post.Meta = call.post.Meta
+		return &post, nil
+	}
+	call = &articleCall{done: make(chan bool)}
+	a.inflight[p.Link] = call
+	a.lock.Unlock()
+
+	call.post, call.err = a.loadContent(p)
+
+	a.lock.Lock()
+	delete(a.inflight, p.Link)
+	a.lock.Unlock()
+	close(call.done)
+	return call.post, call.err
+}
+
+// storedContent returns a copy of p with the content of its article as
+// stored. Content stored before it was sanitized on extraction is sanitized
+// on the way out.
+func (a *Articles) storedContent(p *Post) (*Post, error) {
+	post := *p
+	if err := a.store.PostFetchContent(&post); err != nil {
+		return nil, err
+	}
+	base, _ := neturl.Parse(post.Link)
+	post.Content = readability.Sanitize(post.Content, base)
+	return &post, nil
+}
+
+// loadContent returns a copy of p with the content of its article, which is
+// fetched and stored if the store does not have it yet.
+func (a *Articles) loadContent(p *Post) (*Post, error) {
+	stored, err := a.storedContent(p)
+	if err == nil {
+		return stored, nil
+	}
+	post := *p
+	if err == db.ErrNoContent {
+		content, meta, err := a.fetch(post.Link)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		post.Content, post.Meta = content, string(encoded)
+		if stats != nil {
+			stats.AddReadability(1)
+		}
+		if err = a.store.PostStoreContent(&post); err != nil {
+			a.log.Printf("ERROR: storing content of %s: %s", HashID(post.ID), err.Error())
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testArticle = `<html><head><title>Elections held</title></head><body>
+<div class="article">
+<h1>Elections held</h1>
+<p>Voters went to the polls on Sunday in an election that was, by all accounts,
+closer than anyone had expected when the campaign started in the spring.</p>
+<p>Turnout was high across the country, with long queues reported in the
+capital well into the evening, and results are expected by Monday morning.</p>
+<p>Both candidates thanked their supporters, and said they would respect the
+outcome, whatever it turned out to be, once all the votes were counted.</p>
+</div>
+</body></html>`
+
+func TestArticlesSingleDownload(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		// give everyone time to ask for the article while it is downloaded
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, testArticle)
+	}))
+	defer server.Close()
+
+	for backend, open := range storageBackends {
+		t.Run(backend, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			s := open(t)
+			defer s.Disconnect()
+			feed := addTestFeed(t, s, "a")
+			post := testPost(feed.ID, "elections", time.Now())
+			post.Link = server.URL + "/" + backend + "/elections"
+			addTestPosts(t, s, post)
+
+			a := NewArticles(s, log.New(ioutil.Discard, "", 0))
+			const n = 16
+			var wg sync.WaitGroup
+			contents := make([]string, n)
+			errs := make([]error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					p := *post
+					if i%2 == 0 {
+						errs[i] = a.Prefetch(&p)
+						return
+					}
+					r, err := a.Get(&p)
+					if err == nil {
+						contents[i] = r.Content
+					}
+					errs[i] = err
+				}(i)
+			}
+			wg.Wait()
+
+			for i, err := range errs {
+				if err != nil {
+					t.Fatalf("goroutine %d: %v", i, err)
+				}
+			}
+			for i := 1; i < n; i += 2 {
+				if !strings.Contains(contents[i], "Voters went to the polls") {
+					t.Errorf("goroutine %d: Get returned %q", i, contents[i])
+				}
+			}
+			if n := atomic.LoadInt32(&hits); n != 1 {
+				t.Errorf("article was downloaded %d times, want 1", n)
+			}
+
+			// later requests are answered from memory or the store
+			if _, err := a.Get(post); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewArticles(s, log.New(ioutil.Discard, "", 0)).Get(post); err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt32(&hits); n != 1 {
+				t.Errorf("article was downloaded %d times after it was stored, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+/******************************************************************************
+ * Authentication
+ * Accounts log in with their name and password, administrators alternatively
+ * with the token given by --admin-token. Sessions are kept in memory and
+ * identified by a random cookie. Every session has its own token that forms
+ * changing anything must send along as "csrf".
+ */
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 7 * 24 * time.Hour
+
+	// name of sessions started with the admin token
+	tokenAccount = "admin-token"
+)
+
+var ErrLogin = errors.New("wrong name or password")
+
+type Session struct {
+	ID string
+	// Account is 0 for sessions started with the admin token
+	Account int64
+	Name    string
+	Admin   bool
+	CSRF    string
+	Expires time.Time
+}
+
+type Sessions struct {
+	sessions map[string]*Session
+	lock     sync.Mutex
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{sessions: make(map[string]*Session)}
+}
+
+// randomToken returns 32 random bytes, base64 encoded.
+func randomToken() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// Start creates a new session for account.
+func (s *Sessions) Start(account *Account) (*Session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{id, account.ID, account.Name, account.Admin, csrf, time.Now().Add(sessionLifetime)}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for id, old := range s.sessions {
+		if now.After(old.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sess.ID] = sess
+	return sess, nil
+}
+
+// Get returns the session with the given id, nil if there is none or it
+// expired.
+func (s *Sessions) Get(id string) *Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(sess.Expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	return sess
+}
+
+func (s *Sessions) End(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+}
+
+// HashPassword returns the bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", errors.New("password must have at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// dummyHash is compared against for unknown accounts, so they take as long
+// to reject as wrong passwords.
+var dummyHash = []byte("$2a$10$piDkUcb5sCLXaNIk5NrrXuYN0qA0afPLaCiK2pyCALixGW6QtdrJO")
+
+// authenticate checks a login. With an empty name, password is compared to
+// the admin token.
+func authenticate(store Storage, name, password string) (*Account, error) {
+	if name == "" {
+		token := *serveAdminToken
+		if token != "" && subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1 {
+			return &Account{Name: tokenAccount, Admin: true}, nil
+		}
+		return nil, ErrLogin
+	}
+	account, err := store.AccountGet(name)
+	if err == db.ErrNotFound {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrLogin
+	} else if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.Hash), []byte(password)) != nil {
+		return nil, ErrLogin
+	}
+	return account, nil
+}
+
+// secureRequest reports whether the client talks https to us or a proxy.
+func secureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// login starts a session for account and sets its cookie.
+func login(c *gin.Context, account *Account) error {
+	sess, err := sessions.Start(account)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.ID,
+		Path:     *serveBaseUrl + "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   secureRequest(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// logout ends the current session and removes its cookie.
+func logout(c *gin.Context) {
+	if sess := currentSession(c); sess != nil {
+		sessions.End(sess.ID)
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     *serveBaseUrl + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureRequest(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// currentSession returns the session of the request, nil if there is none.
+func currentSession(c *gin.Context) *Session {
+	id, err := c.Cookie(sessionCookie)
+	if err != nil || id == "" {
+		return nil
+	}
+	return sessions.Get(id)
+}
+
+// validCSRF reports whether a form was sent with the token of sess.
+func validCSRF(c *gin.Context, sess *Session) bool {
+	token := c.PostForm("csrf")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) == 1
+}
+
+// requireAdmin sends everyone without an admin session to the login page and
+// rejects forms without a valid csrf token. The session is stored in the
+// context as "session".
+func requireAdmin(loginURL string) gin.HandlerFunc {
+	return requireSession(loginURL, true)
+}
+
+// requireUser is requireAdmin for any logged in account.
+func requireUser(loginURL string) gin.HandlerFunc {
+	return requireSession(loginURL, false)
+}
+
+func requireSession(loginURL string, admin bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sess := currentSession(c)
+		if sess == nil || (admin && !sess.Admin) {
+			c.Redirect(http.StatusSeeOther, loginURL)
+			c.Abort()
+			return
+		}
+		if c.Request.Method == "POST" && !validCSRF(c, sess) {
+			c.String(http.StatusForbidden, "invalid form token, reload the page")
+			c.Abort()
+			return
+		}
+		c.Set("session", sess)
+		c.Next()
+	}
+}
+
+// readPassword reads a password from the first line of standard input.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// cmdAddAccount creates an account or sets the password and role of an
+// existing one. The password is read from standard input.
+func cmdAddAccount(name string, admin bool) error {
+	if !handleRE.MatchString(name) {
+		return errors.New("invalid account name, use letters and digits")
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	account, err := conn.AccountGet(name)
+	if err == db.ErrNotFound {
+		account = &Account{ID: MakeID(), Name: name, Hash: hash, Admin: admin, Created: time.Now()}
+		return conn.AccountAdd(account)
+	} else if err != nil {
+		return err
+	}
+	account.Hash = hash
+	account.Admin = admin
+	return conn.AccountUpdate(account)
+}
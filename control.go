@@ -0,0 +1,296 @@
+package main
+
+import (
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+/******************************************************************************
+ * Control center
+ * /c/ shows the health of the feeds and the server to administrators and
+ * lets them manage feeds and feed requests. Every action is a POST that
+ * redirects back to /c/ with its outcome in ?msg=.
+ */
+
+// controlFeed is a feed with the number of its stored posts.
+type controlFeed struct {
+	*Feed
+	Posts int64
+}
+
+// trimPosts removes all posts older than PostsMaxAge, along with their
+// cached articles.
+func trimPosts() (int64, error) {
+	before := MakeIDRaw(PostsMaxAge(), 0, 0)
+	n, err := store.PostTrim(before)
+	if err != nil {
+		return n, err
+	}
+	articles.Forget(before)
+	return n, nil
+}
+
+func registerControl(r *gin.Engine, url func(string) string) {
+	done := func(c *gin.Context, msg string) {
+		c.Redirect(http.StatusSeeOther, url("/c/")+"?msg="+neturl.QueryEscape(msg))
+	}
+	moderator := func(c *gin.Context) string {
+		return c.MustGet("session").(*Session).Name
+	}
+
+	admin := r.Group(url("/c"), requireAdmin(url("/u/login")+"?next="+neturl.QueryEscape(url("/c/"))))
+
+	admin.POST("/logout", func(c *gin.Context) {
+		logout(c)
+		c.Redirect(http.StatusSeeOther, url("/"))
+	})
+
+	admin.GET("/", func(c *gin.Context) {
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		counts, err := store.PostCounts()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		requests, err := store.RequestAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+
+		var posts int64 = 0
+		failing, disabled := 0, 0
+		rows := make([]*controlFeed, 0, len(feeds))
+		for _, feed := range feeds {
+			rows = append(rows, &controlFeed{feed, counts[feed.ID]})
+			posts += counts[feed.ID]
+			if feed.Disabled {
+				disabled += 1
+			} else if feed.Failures > 0 {
+				failing += 1
+			}
+		}
+		pending := make([]*FeedReq, 0)
+		for _, req := range requests {
+			if req.Pending() {
+				pending = append(pending, req)
+			}
+		}
+
+		var prefetch *PrefetchCounts
+		if prefetcher != nil {
+			counts := prefetcher.Counts()
+			prefetch = &counts
+		}
+
+		c.HTML(200, "control.tmpl", gin.H{
+			"session":  c.MustGet("session"),
+			"msg":      c.Query("msg"),
+			"feeds":    rows,
+			"posts":    posts,
+			"failing":  failing,
+			"disabled": disabled,
+			"requests": pending,
+			"cached":   articles.CacheSize(),
+			"feedd":    feedd.Timings(),
+			"prefetch": prefetch,
+			"stats":    stats.Rates(),
+			"maxAge":   PostsMaxAge(),
+		})
+	})
+
+	admin.POST("/feeds", func(c *gin.Context) {
+		handle := strings.TrimSpace(c.PostForm("handle"))
+		address := strings.TrimSpace(c.PostForm("url"))
+		if !handleRE.MatchString(handle) {
+			done(c, "invalid handle "+handle)
+			return
+		}
+		if !ValidateURL(address) {
+			done(c, "invalid address "+address)
+			return
+		}
+		var feed Feed
+		feed.ID = MakeID()
+		feed.Handle = handle
+		feed.URL = address
+		feed.Category = strings.Trim(c.PostForm("category"), "/ ")
+		if _, err := store.FeedAdd(&feed); err != nil {
+			done(c, "unable to add feed: "+err.Error())
+			return
+		}
+		feedd.Refresh(feed.ID)
+		done(c, "added "+handle)
+	})
+
+	// feedParam resolves the :handle parameter, it answers the request itself
+	// if that fails.
+	feedParam := func(c *gin.Context) (*Feed, bool) {
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return nil, false
+		}
+		for _, feed := range feeds {
+			if feed.Handle == c.Param("handle") {
+				return feed, true
+			}
+		}
+		done(c, "no feed "+c.Param("handle"))
+		return nil, false
+	}
+
+	admin.POST("/feeds/:handle", func(c *gin.Context) {
+		feed, ok := feedParam(c)
+		if !ok {
+			return
+		}
+		handle := strings.TrimSpace(c.PostForm("handle"))
+		address := strings.TrimSpace(c.PostForm("url"))
+		if !handleRE.MatchString(handle) {
+			done(c, "invalid handle "+handle)
+			return
+		}
+		if !ValidateURL(address) {
+			done(c, "invalid address "+address)
+			return
+		}
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		for _, other := range feeds {
+			if other.ID != feed.ID && (other.Handle == handle || other.URL == address) {
+				done(c, "handle or address already used by "+other.Handle)
+				return
+			}
+		}
+		if address != feed.URL {
+			// validators belong to the old address
+			feed.ETag = ""
+			feed.LastModified = ""
+		}
+		if title := strings.TrimSpace(c.PostForm("title")); title != feed.Title {
+			// an empty title is filled in by the next fetch
+			feed.Title = title
+			feed.Initialized = title != ""
+		}
+		feed.Handle = handle
+		feed.URL = address
+		feed.Category = strings.Trim(c.PostForm("category"), "/ ")
+		if err := store.FeedUpdate(feed); err != nil {
+			done(c, "unable to update feed: "+err.Error())
+			return
+		}
+		done(c, "updated "+handle)
+	})
+
+	admin.POST("/feeds/:handle/disable", func(c *gin.Context) {
+		feed, ok := feedParam(c)
+		if !ok {
+			return
+		}
+		feed.Disabled = true
+		if err := store.FeedUpdate(feed); err != nil {
+			done(c, "unable to disable feed: "+err.Error())
+			return
+		}
+		done(c, "disabled "+feed.Handle)
+	})
+
+	admin.POST("/feeds/:handle/enable", func(c *gin.Context) {
+		feed, ok := feedParam(c)
+		if !ok {
+			return
+		}
+		feed.Disabled = false
+		feed.Failures = 0
+		feed.NextFetch = time.Now()
+		if err := store.FeedUpdate(feed); err != nil {
+			done(c, "unable to enable feed: "+err.Error())
+			return
+		}
+		done(c, "enabled "+feed.Handle)
+	})
+
+	admin.POST("/feeds/:handle/prefetch", func(c *gin.Context) {
+		feed, ok := feedParam(c)
+		if !ok {
+			return
+		}
+		feed.Prefetch = c.PostForm("on") == "1"
+		if err := store.FeedUpdate(feed); err != nil {
+			done(c, "unable to update feed: "+err.Error())
+			return
+		}
+		if feed.Prefetch {
+			done(c, "prefetching new articles of "+feed.Handle)
+			return
+		}
+		done(c, "stopped prefetching articles of "+feed.Handle)
+	})
+
+	admin.POST("/feeds/:handle/delete", func(c *gin.Context) {
+		n, err := store.FeedRemoveByHandleOrURL(c.Param("handle"))
+		if err != nil {
+			done(c, "unable to delete feed: "+err.Error())
+			return
+		}
+		done(c, "deleted "+c.Param("handle")+" and "+strconv.FormatInt(n, 10)+" posts")
+	})
+
+	admin.POST("/refresh", func(c *gin.Context) {
+		feedd.Refresh()
+		done(c, "refreshing all feeds")
+	})
+
+	admin.POST("/trim", func(c *gin.Context) {
+		n, err := trimPosts()
+		if err != nil {
+			done(c, "unable to trim posts: "+err.Error())
+			return
+		}
+		done(c, "trimmed "+strconv.FormatInt(n, 10)+" posts")
+	})
+
+	admin.POST("/requests/approve", func(c *gin.Context) {
+		address := c.PostForm("url")
+		handle := strings.TrimSpace(c.PostForm("handle"))
+		feed, err := approveRequest(store, feedd, address, handle, moderator(c))
+		if err != nil {
+			done(c, "unable to approve "+address+": "+err.Error())
+			return
+		}
+		done(c, "added "+feed.URL+" as "+feed.Handle)
+	})
+
+	admin.POST("/requests/reject", func(c *gin.Context) {
+		address := c.PostForm("url")
+		if err := decideRequest(store, address, db.RequestRejected, moderator(c)); err != nil {
+			done(c, "unable to reject "+address+": "+err.Error())
+			return
+		}
+		done(c, "rejected "+address)
+	})
+
+	admin.POST("/requests/ban", func(c *gin.Context) {
+		address := c.PostForm("url")
+		if err := decideRequest(store, address, db.RequestBanned, moderator(c)); err != nil {
+			done(c, "unable to ban "+address+": "+err.Error())
+			return
+		}
+		done(c, "banned "+address)
+	})
+}
@@ -1,78 +1,132 @@
-package db;
+package db
 
 import (
-	"time"
-	"strings"
-	"fmt"
-	"errors"
 	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 	_ "github.com/lib/pq"
-	_ "github.com/ziutek/mymysql"
+	_ "github.com/mattn/go-sqlite3"
+	_ "github.com/ziutek/mymysql/godrv"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrNoContent    = errors.New("content not fetched yet")
+	ErrBanned       = errors.New("this feed may not be requested")
+	ErrRequestLimit = errors.New("maximum number of feed requests reached")
+)
+
+// States of a feed request, pending requests have none.
+const (
+	RequestPending  = ""
+	RequestApproved = "approved"
+	RequestRejected = "rejected"
+	RequestBanned   = "banned"
 )
 
 type Feed struct {
-	ID     int64  `db:"id"`
-	Handle string `db:"handle"`
-	Title  string `db:"title"`
-	Link   string `db:"link"`
-	URL    string `db:"url"`
+	ID          int64  `db:"id" json:"id"`
+	Initialized bool   `db:"initialized" json:"initialized"`
+	Handle      string `db:"handle" json:"handle"`
+	Title       string `db:"title" json:"title,omitempty"`
+	Link        string `db:"link" json:"link,omitempty"`
+	URL         string `db:"url" json:"url"`
+	ImageURL    string `db:"image_url" json:"imageurl,omitempty"`
+	Category    string `db:"category" json:"category,omitempty"`
+
+	// validators for conditional fetching
+	ETag         string `db:"etag" json:"etag,omitempty"`
+	LastModified string `db:"last_modified" json:"lastmodified,omitempty"`
+
+	// polling schedule
+	Interval  time.Duration `db:"poll_interval" json:"interval,omitempty"`
+	NextFetch time.Time     `db:"next_fetch" json:"nextfetch"`
+
+	// health, updated after every fetch
+	LastSuccess time.Time `db:"last_success" json:"lastsuccess"`
+	LastError   string    `db:"last_error" json:"lasterror,omitempty"`
+	Failures    int       `db:"failures" json:"failures,omitempty"`
+	Status      int       `db:"status" json:"status,omitempty"`
+	Disabled    bool      `db:"disabled" json:"disabled,omitempty"`
+
+	// extract the articles of new posts right away
+	Prefetch bool `db:"prefetch" json:"prefetch,omitempty"`
 }
 
 type Post struct {
-	ID      int64      `db:"id"`
-	Title   string     `db:"title"`
-	GUID    string     `db:"guid"`
-	Link    string     `db:"link"`
-	Feed    int64      `db:"feed"`
-	Date    time.Time  `db:"time"`
-	Content string     `db:"content"`
+	ID          int64     `db:"id" json:"id"`
+	Title       string    `db:"title" json:"title"`
+	GUID        string    `db:"guid" json:"guid"`
+	Fingerprint string    `db:"fingerprint" json:"fingerprint,omitempty"`
+	Link        string    `db:"link" json:"link"`
+	Feed        int64     `db:"feed" json:"feed"`
+	Date        time.Time `db:"time" json:"-"`
+	Content     string    `db:"content" json:"-"`
+	// metadata of the extracted article, JSON encoded
+	Meta string `db:"meta" json:"-"`
 }
 
 type FeedReq struct {
-	ID   int64
-	URL  string
-	N    int
-	Date time.Time
+	ID   int64     `db:"id" json:"id"`
+	URL  string    `db:"url" json:"url"`
+	N    int       `db:"num" json:"n"`
+	Date time.Time `db:"time" json:"date"`
+
+	// moderation, Handle is the handle of the feed created on approval
+	Status    string    `db:"status" json:"status,omitempty"`
+	DecidedBy string    `db:"decided_by" json:"decidedby,omitempty"`
+	DecidedAt time.Time `db:"decided_at" json:"decidedat"`
+	Handle    string    `db:"handle" json:"handle,omitempty"`
+}
+
+// Pending reports whether no decision about the request was made yet.
+func (r *FeedReq) Pending() bool {
+	return r.Status == RequestPending
+}
+
+// Account is someone who can log in, Hash is the bcrypt hash of the
+// password.
+type Account struct {
+	ID      int64     `db:"id" json:"id"`
+	Name    string    `db:"name" json:"name"`
+	Hash    string    `db:"hash" json:"hash"`
+	Admin   bool      `db:"admin" json:"admin,omitempty"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+// ReadState is what a reader has read: every post of a feed with an id up to
+// the mark of the feed, and the posts in Read. Since post ids follow the
+// publication date, posts that show up late with an old date count as read.
+type ReadState struct {
+	Marks map[int64]int64
+	Read  map[int64]bool
+}
+
+func NewReadState() *ReadState {
+	return &ReadState{Marks: make(map[int64]int64), Read: make(map[int64]bool)}
+}
+
+// IsRead reports whether post was read.
+func (r *ReadState) IsRead(post *Post) bool {
+	return post.ID <= r.Marks[post.Feed] || r.Read[post.ID]
 }
 
 type DB struct {
 	db *sqlx.DB
+
+	maxRequests int
 }
 
-var schema = `
-CREATE TABLE IF NOT EXISTS settings (
-	name TEXT PRIMARY KEY UNIQUE,
-	value TEXT 
-);
-CREATE TABLE IF NOT EXISTS feeds (
-	id INTEGER PRIMARY KEY NOT NULL,
-	handle TEXT UNIQUE,
-	title TEXT,
-	link TEXT,
-	url TEXT UNIQUE
-);
-CREATE TABLE IF NOT EXISTS posts (
-	id INTEGER PRIMARY KEY NOT NULL,
-	title TEXT,
-	guid TEXT UNIQUE,
-	link TEXT,
-	feed INTEGER,
-	time DATETIME,
-	content TEXT,
-	FOREIGN KEY(feed) REFERENCES feeds(id)
-);
-CREATE TABLE IF NOT EXISTS requests (
-	id INTEGER PRIMARY KEY NOT NULL,
-	url TEXT,
-	num INTEGER
-);
-`
 ///////////////////////////////////////////////////////////
 // general functionality
 
-func Connect(url string) (*DB, error) {
+// Open connects to the database at url, given as <driver>://<source>. The
+// drivers are sqlite3, postgres and mysql. The schema is left as it is, see
+// Migrate.
+func Open(url string) (*DB, error) {
 	if url == "" {
 		return nil, errors.New("invalid connection string")
 	}
@@ -82,20 +136,38 @@ func Connect(url string) (*DB, error) {
 	}
 
 	var (
-		db *sqlx.DB
+		db  *sqlx.DB
 		err error
 	)
 
-	if db, err = sqlx.Connect(parts[0], parts[1]); err != nil {
-		return nil, err
+	// lib/pq understands postgres:// urls, the other drivers only the source
+	driver, source := parts[0], parts[1]
+	switch driver {
+	case "postgres":
+		source = url
+	case "mysql":
+		driver = "mymysql"
 	}
 
-	if _, err = db.Exec(schema); err != nil {
-		db.Close()
+	if db, err = sqlx.Connect(driver, source); err != nil {
 		return nil, err
 	}
 
-	return &DB{db}, nil
+	return &DB{db, 64}, nil
+}
+
+// Connect opens the database at url and makes sure its schema is up to
+// date.
+func Connect(url string) (*DB, error) {
+	db, err := Open(url)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.checkVersion(); err != nil {
+		db.Disconnect()
+		return nil, err
+	}
+	return db, nil
 }
 
 func (db *DB) Disconnect() {
@@ -105,154 +177,864 @@ func (db *DB) Disconnect() {
 	db.db = nil
 }
 
+// rowsAffected turns an update that did not match any row into ErrNotFound.
+func rowsAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if nrows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if nrows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// rowsMatched is rowsAffected for updates. mysql only counts the rows an
+// update changed, so an update that changed nothing is only ErrNotFound if
+// exists, a query counting the rows the update was meant for, finds none.
+func rowsMatched(q sqlx.Ext, res sql.Result, err error, exists string, args ...interface{}) error {
+	if err = rowsAffected(res, err); err != ErrNotFound {
+		return err
+	}
+	var n int
+	if err = sqlx.Get(q, &n, q.Rebind(exists), args...); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////
+// settings
+
+func (db *DB) SettingGet(name string) (string, error) {
+	query := db.db.Rebind(`SELECT value FROM settings WHERE name = ?`)
+	var value sql.NullString
+	if err := db.db.Get(&value, query, name); err == sql.ErrNoRows {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return value.String, nil
+}
+
+func (db *DB) SettingSet(name, value string) error {
+	update := db.db.Rebind(`UPDATE settings SET value = ? WHERE name = ?`)
+	res, err := db.db.Exec(update, value, name)
+	err = rowsMatched(db.db, res, err, `SELECT COUNT(*) FROM settings WHERE name = ?`, name)
+	if err == ErrNotFound {
+		insert := db.db.Rebind(`INSERT INTO settings(name, value) VALUES (?, ?)`)
+		_, err = db.db.Exec(insert, name, value)
+	}
+	return err
+}
+
 ///////////////////////////////////////////////////////////
 // feed management
 
-// ID     int64  `db:"id"`
-// Handle string `db:"handle"`
-// Title  string `db:"title"`
-// Link   string `db:"link"`
-// URL    string `db:"url"`
+// columns that may be NULL are coalesced or scanned into a feedRow
+const feedColumns = `id, initialized, handle, COALESCE(title, '') AS title,
+	COALESCE(link, '') AS link, url, image_url, etag, last_modified,
+	poll_interval, next_fetch AS null_next_fetch, last_success AS null_last_success,
+	last_error, failures, status, disabled, category, prefetch`
+
+type feedRow struct {
+	Feed
+	NullNextFetch   sql.NullTime `db:"null_next_fetch"`
+	NullLastSuccess sql.NullTime `db:"null_last_success"`
+}
+
+func (r *feedRow) feed() *Feed {
+	f := r.Feed
+	f.NextFetch = r.NullNextFetch.Time
+	f.LastSuccess = r.NullLastSuccess.Time
+	return &f
+}
 
+// FeedAdd inserts a new feed. The caller is responsible for choosing a
+// unique id.
 func (db *DB) FeedAdd(feed *Feed) (int64, error) {
-	query := "INSERT INTO feeds(handle, url) VALUES (:handle, :url)"
-	if res, err := db.db.NamedExec(query, feed); err != nil {
-		return -1, err
-	} else if id, err := res.LastInsertId(); err != nil {
+	if feed.ID <= 0 {
+		return -1, errors.New("invalid feed id")
+	}
+	query := `INSERT INTO feeds(id, initialized, handle, title, link, url, image_url,
+			etag, last_modified, poll_interval, next_fetch, last_success,
+			last_error, failures, status, disabled, category, prefetch)
+		VALUES (:id, :initialized, :handle, :title, :link, :url, :image_url,
+			:etag, :last_modified, :poll_interval, :next_fetch, :last_success,
+			:last_error, :failures, :status, :disabled, :category, :prefetch)`
+	if _, err := db.db.NamedExec(query, feed); err != nil {
 		return -1, err
-	} else {
-		feed.ID = id
-		return id, nil
 	}
+	return feed.ID, nil
 }
 
 func (db *DB) FeedUpdate(feed *Feed) error {
-	query := "UPDATE feeds SET handle = :handle, URL = :url, title = :title, link = :link WHERE id = :id"
-	res, _ := db.db.NamedExec(query, feed)
-	if nrows, err := res.RowsAffected(); err != nil {
-		return err
-	} else if nrows == 0 {
-		return errors.New("invalid feed")
-	} else {
-		return nil
+	query := `UPDATE feeds SET initialized = :initialized, handle = :handle,
+		title = :title, link = :link, url = :url, image_url = :image_url,
+		etag = :etag, last_modified = :last_modified,
+		poll_interval = :poll_interval, next_fetch = :next_fetch,
+		last_success = :last_success, last_error = :last_error,
+		failures = :failures, status = :status, disabled = :disabled,
+		category = :category, prefetch = :prefetch
+		WHERE id = :id`
+	res, err := db.db.NamedExec(query, feed)
+	return rowsMatched(db.db, res, err, `SELECT COUNT(*) FROM feeds WHERE id = ?`, feed.ID)
+}
+
+// FeedRemoveByHandleOrURL removes a feed together with its posts, their
+// content, their search terms, the subscriptions to the feed and its read
+// state. Saved posts of the feed are removed as well. It returns the number
+// of removed posts.
+func (db *DB) FeedRemoveByHandleOrURL(handleOrURL string) (int64, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	query := tx.Rebind(`SELECT id FROM feeds WHERE handle = ? OR url = ?`)
+	if err = tx.Get(&id, query, handleOrURL, handleOrURL); err == sql.ErrNoRows {
+		return 0, errors.New("no feed with that handle or url")
+	} else if err != nil {
+		return 0, err
 	}
+
+	for _, table := range []string{"subscriptions", "read_marks", "read_posts"} {
+		if _, err = tx.Exec(tx.Rebind(`DELETE FROM `+table+` WHERE feed = ?`), id); err != nil {
+			return 0, err
+		}
+	}
+	for _, table := range []string{"terms", "saved"} {
+		query = tx.Rebind(`DELETE FROM ` + table + ` WHERE post IN (SELECT id FROM posts WHERE feed = ?)`)
+		if _, err = tx.Exec(query, id); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec(tx.Rebind(`DELETE FROM posts WHERE feed = ?`), id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(tx.Rebind(`DELETE FROM feeds WHERE id = ?`), id); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
 }
 
-func (db *DB) FeedRemoveByHandleOrURL(handleOrURL string) error {
-	query := "DELETE FROM feeds WHERE handle = $1 or url = $1";
-	res, _ := db.db.Exec(query, handleOrURL)
-	if nrows, err := res.RowsAffected(); err != nil {
-		return err
-	} else if nrows == 0 {
-		return errors.New("no feed with that handle or url")
-	} else {
-		return nil
+func (db *DB) FeedGet(id int64) (*Feed, error) {
+	query := db.db.Rebind(`SELECT ` + feedColumns + ` FROM feeds WHERE id = ?`)
+	var row feedRow
+	if err := db.db.Get(&row, query, id); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
 	}
+	return row.feed(), nil
 }
 
 func (db *DB) FeedAll() ([]*Feed, error) {
-	query := `SELECT * FROM feeds;`
-	feeds := []*struct{
-		ID int64
-		Handle string
-		Title  sql.NullString
-		Link   sql.NullString
-		URL    string
-	}{}
-	if err := db.db.Select(&feeds, query); err != nil {
+	query := `SELECT ` + feedColumns + ` FROM feeds ORDER BY handle;`
+	rows := []*feedRow{}
+	if err := db.db.Select(&rows, query); err != nil {
 		return nil, err
 	}
-	feedsReal := []*Feed{}
-	for _, f := range(feeds) {
-		feedsReal = append(feedsReal, &Feed{f.ID, f.Handle, f.Title.String, f.Link.String, f.URL})
+	feeds := []*Feed{}
+	for _, row := range rows {
+		feeds = append(feeds, row.feed())
 	}
-	return feedsReal, nil
+	return feeds, nil
 }
 
-
 ///////////////////////////////////////////////////////////
 // post management
 
-// ID      int64      `db:"id"`
-// Title   string     `db:"title"`
-// GUID    string     `db:"guid"`
-// Link    string     `db:"link"`
-// Feed    int64      `db:"feed"`
-// Date    time.Time  `db:"time"`
-// Content string     `db:"content"`
+const postColumns = `id, COALESCE(title, '') AS title, COALESCE(guid, '') AS guid,
+	fingerprint, COALESCE(link, '') AS link, feed, time`
 
 func (db *DB) PostAdd(post *Post) (int64, error) {
-	query := `REPLACE INTO posts(title, guid, link, feed, time)
-		VALUES (:title, :guid, :link, :feed, :time)`
-	if res, err := db.db.NamedExec(query, post); err != nil {
-		return -1, err
-	} else if id, err := res.LastInsertId(); err != nil {
+	if post.ID <= 0 {
+		return -1, errors.New("invalid post id")
+	}
+	query := `INSERT INTO posts(id, title, guid, fingerprint, link, feed, time)
+		VALUES (:id, :title, :guid, :fingerprint, :link, :feed, :time)`
+	if _, err := db.db.NamedExec(query, post); err != nil {
 		return -1, err
-	} else {
-		post.ID = id
-		return id, nil
 	}
+	return post.ID, nil
 }
 
-func (db *DB) PostAddBatch(posts []*Post) error {
-	nerr := 0
-	for _, post := range(posts) {
-		_, err := db.PostAdd(post)
-		if err != nil {
-			nerr += 1
+// PostAddBatch inserts all posts whose guid is not known in their feed and
+// whose fingerprint is not known at all, and returns the posts actually
+// inserted.
+func (db *DB) PostAddBatch(posts []*Post) ([]*Post, error) {
+	inserted := []*Post{}
+	if len(posts) == 0 {
+		return inserted, nil
+	}
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	exists := tx.Rebind(`SELECT COUNT(*) FROM posts
+		WHERE (feed = ? AND guid = ?) OR (fingerprint <> '' AND fingerprint = ?)`)
+	insert := `INSERT INTO posts(id, title, guid, fingerprint, link, feed, time)
+		VALUES (:id, :title, :guid, :fingerprint, :link, :feed, :time)`
+	feedTitle := tx.Rebind(`SELECT COALESCE(title, '') FROM feeds WHERE id = ?`)
+	feedTitles := make(map[int64]string)
+	for _, post := range posts {
+		var n int
+		if err := tx.Get(&n, exists, post.Feed, post.GUID, post.Fingerprint); err != nil {
+			return nil, err
 		}
+		if n > 0 {
+			continue
+		}
+		if _, err := tx.NamedExec(insert, post); err != nil {
+			return nil, err
+		}
+		title, ok := feedTitles[post.Feed]
+		if !ok {
+			if err := tx.Get(&title, feedTitle, post.Feed); err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			feedTitles[post.Feed] = title
+		}
+		if err := indexTerms(tx, post.ID, Terms(post.Title, title)); err != nil {
+			return nil, err
+		}
+		inserted = append(inserted, post)
 	}
-	if nerr > 0 {
-		return errors.New(fmt.Sprintf("failed to add %d posts", nerr))
-	} else {
-		return nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
+	return inserted, nil
 }
 
-func (db *DB) PostNAfter(n int, after time.Time) ([]*Post, error) {
-	query := `SELECT id,title,guid,link,feed,date FROM posts WHERE time < $2 LIMIT $1 ORDER BY time DESC;`
-	posts := []*struct{
-		ID     int64
-		Title  sql.NullString
-		GUID   sql.NullString
-		Link   sql.NullString
-		Feed   int64
-		Date   time.Time
+func (db *DB) PostGet(id int64) (*Post, error) {
+	query := db.db.Rebind(`SELECT ` + postColumns + ` FROM posts WHERE id = ?`)
+	var post Post
+	if err := db.db.Get(&post, query, id); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// PostCounts returns the number of stored posts per feed id.
+func (db *DB) PostCounts() (map[int64]int64, error) {
+	rows := []struct {
+		Feed  int64 `db:"feed"`
+		Count int64 `db:"n"`
 	}{}
-	if err := db.db.Select(&posts, query, n, after); err != nil {
+	if err := db.db.Select(&rows, `SELECT feed, COUNT(*) AS n FROM posts GROUP BY feed`); err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64)
+	for _, row := range rows {
+		counts[row.Feed] = row.Count
+	}
+	return counts, nil
+}
+
+// PostNAfter returns the n newest posts published before the given time.
+func (db *DB) PostNAfter(n int, after time.Time) ([]*Post, error) {
+	query := db.db.Rebind(`SELECT ` + postColumns + ` FROM posts
+		WHERE time < ? ORDER BY time DESC LIMIT ?`)
+	posts := []*Post{}
+	if err := db.db.Select(&posts, query, after, n); err != nil {
 		return nil, err
 	}
-	postsReal := []*Post{}
-	for _, p := range(posts) {
-		postsReal = append(postsReal, &Post{
-			p.ID,
-			p.Title.String,
-			p.GUID.String,
-			p.Link.String,
-			p.Feed,
-			p.Date,
-			"",
-		})
+	return posts, nil
+}
+
+// PostPage returns the n newest posts with an id below before. Since post
+// ids are snowflakes, this pages backwards through time. If feeds is not
+// nil, only posts of these feeds are returned.
+func (db *DB) PostPage(n int, before int64, feeds []int64) ([]*Post, error) {
+	posts := []*Post{}
+	var (
+		query string
+		args  []interface{}
+		err   error
+	)
+	if feeds == nil {
+		query = `SELECT ` + postColumns + ` FROM posts
+			WHERE id < ? ORDER BY id DESC LIMIT ?`
+		args = []interface{}{before, n}
+	} else if len(feeds) == 0 {
+		return posts, nil
+	} else {
+		query, args, err = sqlx.In(`SELECT `+postColumns+` FROM posts
+			WHERE id < ? AND feed IN (?) ORDER BY id DESC LIMIT ?`, before, feeds, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = db.db.Select(&posts, db.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// PostTrim removes all posts with an id below before, except for saved ones,
+// and returns the number of posts removed.
+func (db *DB) PostTrim(before int64) (int64, error) {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"terms", "read_posts"} {
+		query := tx.Rebind(`DELETE FROM ` + table + ` WHERE post < ? AND post NOT IN (SELECT post FROM saved)`)
+		if _, err = tx.Exec(query, before); err != nil {
+			return 0, err
+		}
+	}
+	query := tx.Rebind(`DELETE FROM posts WHERE id < ? AND id NOT IN (SELECT post FROM saved)`)
+	res, err := tx.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
 	}
-	return postsReal, nil
+	return n, tx.Commit()
 }
 
 ///////////////////////////////////////////////////////////
 // content management
 
+// PostFetchContent loads the extracted article content of a post into
+// post.Content. It returns ErrNoContent if it has not been stored yet.
 func (db *DB) PostFetchContent(post *Post) error {
-	query := `SELECT content FROM posts WHERE id = $1`
-	postContent := struct{
-		Content sql.NullString
+	query := db.db.Rebind(`SELECT content, meta FROM posts WHERE id = ?`)
+	var row struct {
+		Content sql.NullString `db:"content"`
+		Meta    sql.NullString `db:"meta"`
+	}
+	if err := db.db.Get(&row, query, post.ID); err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if !row.Content.Valid {
+		return ErrNoContent
+	}
+	post.Content = row.Content.String
+	post.Meta = row.Meta.String
+	return nil
+}
+
+// PostStoreContent stores post.Content as the extracted article content and
+// post.Meta as its metadata.
+func (db *DB) PostStoreContent(post *Post) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := tx.Rebind(`UPDATE posts SET content = ?, meta = ? WHERE id = ?`)
+	res, err := tx.Exec(query, post.Content, post.Meta, post.ID)
+	if err = rowsMatched(tx, res, err, `SELECT COUNT(*) FROM posts WHERE id = ?`, post.ID); err != nil {
+		return err
+	}
+	if err = indexTerms(tx, post.ID, Terms(post.Content)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+///////////////////////////////////////////////////////////
+// search
+
+// indexTerms adds terms to the search index of a post, terms already indexed
+// are skipped.
+func indexTerms(tx *sqlx.Tx, post int64, terms []string) error {
+	known := []string{}
+	if err := tx.Select(&known, tx.Rebind(`SELECT term FROM terms WHERE post = ?`), post); err != nil {
+		return err
+	}
+	skip := make(map[string]bool)
+	for _, term := range known {
+		skip[term] = true
+	}
+	insert := tx.Rebind(`INSERT INTO terms(term, post) VALUES (?, ?)`)
+	for _, term := range terms {
+		if skip[term] {
+			continue
+		}
+		if _, err := tx.Exec(insert, term, post); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexAllPosts builds the search index for all posts.
+func indexAllPosts(tx *sqlx.Tx) error {
+	rows := []struct {
+		ID        int64  `db:"id"`
+		Title     string `db:"title"`
+		FeedTitle string `db:"feed_title"`
+		Content   string `db:"content"`
 	}{}
-	if err := db.db.Select(&postContent, query, post.ID); err != nil {
+	query := `SELECT posts.id AS id, COALESCE(posts.title, '') AS title,
+		COALESCE(feeds.title, '') AS feed_title, COALESCE(posts.content, '') AS content
+		FROM posts LEFT JOIN feeds ON posts.feed = feeds.id`
+	if err := tx.Select(&rows, query); err != nil {
 		return err
 	}
-	// post content already fetched, we're good, just update and return
-	if postContent.Content.Valid {
-		post.Content = postContent.Content.String
+	for _, row := range rows {
+		if err := indexTerms(tx, row.ID, Terms(row.Title, row.FeedTitle, row.Content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostSearch returns the n newest posts with an id below before that match
+// the query. Posts are found through the term index, phrases and dates are
+// checked on the candidates.
+func (db *DB) PostSearch(q *Query, n int, before int64) ([]*Post, error) {
+	where := []string{"id < ?"}
+	args := []interface{}{before}
+	for _, term := range q.Terms {
+		where = append(where, "id IN (SELECT post FROM terms WHERE term = ?)")
+		args = append(args, term)
+	}
+	if len(q.Feeds) > 0 {
+		where = append(where, "feed IN (SELECT id FROM feeds WHERE handle IN (?))")
+		args = append(args, q.Feeds)
+	}
+	query, args, err := sqlx.In(`SELECT `+postColumns+` FROM posts
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY id DESC LIMIT ?`, append(args, n)...)
+	if err != nil {
+		return nil, err
+	}
+	query = db.db.Rebind(query)
+
+	posts := []*Post{}
+	for len(posts) < n {
+		batch := []*Post{}
+		if err := db.db.Select(&batch, query, args...); err != nil {
+			return nil, err
+		}
+		for _, post := range batch {
+			// ids grow with the publication date, nothing older will match
+			if !q.After.IsZero() && post.Date.Before(q.After) {
+				return posts, nil
+			}
+			if !q.MatchDate(post.Date) {
+				continue
+			}
+			if len(q.Phrases) > 0 {
+				match, err := db.matchPhrases(q, post)
+				if err != nil {
+					return nil, err
+				}
+				if !match {
+					continue
+				}
+			}
+			posts = append(posts, post)
+			if len(posts) == n {
+				break
+			}
+		}
+		if len(batch) < n {
+			break
+		}
+		// page on from the last candidate
+		args[0] = batch[len(batch)-1].ID
+	}
+	return posts, nil
+}
+
+func (db *DB) matchPhrases(q *Query, post *Post) (bool, error) {
+	var text struct {
+		FeedTitle string `db:"feed_title"`
+		Content   string `db:"content"`
+	}
+	query := db.db.Rebind(`SELECT COALESCE(feeds.title, '') AS feed_title,
+		COALESCE(posts.content, '') AS content
+		FROM posts LEFT JOIN feeds ON posts.feed = feeds.id WHERE posts.id = ?`)
+	if err := db.db.Get(&text, query, post.ID); err != nil {
+		return false, err
+	}
+	return q.MatchPhrases(post.Title, text.FeedTitle, text.Content), nil
+}
+
+///////////////////////////////////////////////////////////
+// feed requests
+
+const requestColumns = `id, url, num, time, COALESCE(status, '') AS status,
+	COALESCE(decided_by, '') AS decided_by, decided_at AS null_decided_at,
+	COALESCE(handle, '') AS handle`
+
+type requestRow struct {
+	FeedReq
+	NullDecidedAt sql.NullTime `db:"null_decided_at"`
+}
+
+func (r *requestRow) request() *FeedReq {
+	req := r.FeedReq
+	req.DecidedAt = r.NullDecidedAt.Time
+	return &req
+}
+
+// RequestAdd records a request for the feed at url, or counts another
+// request if it was requested before. Requesting a rejected or approved feed
+// again reopens the request, banned feeds return ErrBanned. New requests
+// beyond the limit of pending ones return ErrRequestLimit.
+func (db *DB) RequestAdd(id int64, url string) error {
+	if url == "" {
+		return errors.New("invalid feed request url")
+	}
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status sql.NullString
+	query := tx.Rebind(`SELECT status FROM requests WHERE url = ?`)
+	err = tx.Get(&status, query, url)
+	switch {
+	case err == sql.ErrNoRows:
+		var n int
+		query = tx.Rebind(`SELECT COUNT(*) FROM requests WHERE status = ?`)
+		if err = tx.Get(&n, query, RequestPending); err != nil {
+			return err
+		}
+		if n >= db.maxRequests {
+			return ErrRequestLimit
+		}
+		query = tx.Rebind(`INSERT INTO requests(id, url, num, time, status, decided_by, handle)
+			VALUES (?, ?, 1, ?, ?, '', '')`)
+		_, err = tx.Exec(query, id, url, time.Now().UTC(), RequestPending)
+	case err != nil:
+		return err
+	case status.String == RequestBanned:
+		return ErrBanned
+	case status.String != RequestPending:
+		query = tx.Rebind(`UPDATE requests SET num = 1, time = ?, status = ?,
+			decided_by = '', decided_at = NULL, handle = '' WHERE url = ?`)
+		_, err = tx.Exec(query, time.Now().UTC(), RequestPending, url)
+	default:
+		query = tx.Rebind(`UPDATE requests SET num = num + 1, time = ? WHERE url = ?`)
+		_, err = tx.Exec(query, time.Now().UTC(), url)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RequestImport stores req as it is, keeping its id, count and date.
+func (db *DB) RequestImport(req *FeedReq) error {
+	query := `INSERT INTO requests(id, url, num, time, status, decided_by, decided_at, handle)
+		VALUES (:id, :url, :num, :time, :status, :decided_by, :decided_at, :handle)`
+	_, err := db.db.NamedExec(query, requestArgs(req))
+	return err
+}
+
+// requestArgs are the named arguments for storing req, the zero time of
+// undecided requests is stored as NULL.
+func requestArgs(req *FeedReq) map[string]interface{} {
+	return map[string]interface{}{
+		"id": req.ID, "url": req.URL, "num": req.N, "time": req.Date,
+		"status": req.Status, "decided_by": req.DecidedBy, "handle": req.Handle,
+		"decided_at": sql.NullTime{Time: req.DecidedAt, Valid: !req.DecidedAt.IsZero()},
+	}
+}
+
+// RequestDecide records the decision stored in req for the request of
+// req.URL. Requests that do not exist yet are created, so feeds can be
+// banned before anyone asked for them.
+func (db *DB) RequestDecide(req *FeedReq) error {
+	query := `UPDATE requests SET status = :status, decided_by = :decided_by,
+		decided_at = :decided_at, handle = :handle WHERE url = :url`
+	res, err := db.db.NamedExec(query, requestArgs(req))
+	err = rowsMatched(db.db, res, err, `SELECT COUNT(*) FROM requests WHERE url = ?`, req.URL)
+	if err == ErrNotFound {
+		return db.RequestImport(req)
+	}
+	return err
+}
+
+func (db *DB) RequestGet(url string) (*FeedReq, error) {
+	query := db.db.Rebind(`SELECT ` + requestColumns + ` FROM requests WHERE url = ?`)
+	var row requestRow
+	if err := db.db.Get(&row, query, url); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return row.request(), nil
+}
+
+func (db *DB) RequestAll() ([]*FeedReq, error) {
+	query := `SELECT ` + requestColumns + ` FROM requests ORDER BY num DESC`
+	rows := []*requestRow{}
+	if err := db.db.Select(&rows, query); err != nil {
+		return nil, err
+	}
+	reqs := []*FeedReq{}
+	for _, row := range rows {
+		reqs = append(reqs, row.request())
+	}
+	return reqs, nil
+}
+
+func (db *DB) RequestRemove(url string) error {
+	query := db.db.Rebind(`DELETE FROM requests WHERE url = ?`)
+	return rowsAffected(db.db.Exec(query, url))
+}
+
+// RequestRemoveAll removes all requests except bans.
+func (db *DB) RequestRemoveAll() error {
+	query := db.db.Rebind(`DELETE FROM requests WHERE status IS NULL OR status <> ?`)
+	_, err := db.db.Exec(query, RequestBanned)
+	return err
+}
+
+///////////////////////////////////////////////////////////
+// accounts
+
+// AccountAdd inserts a new account. The caller is responsible for choosing
+// a unique id.
+func (db *DB) AccountAdd(account *Account) error {
+	if account.ID <= 0 || account.Name == "" {
+		return errors.New("invalid account")
+	}
+	query := `INSERT INTO accounts(id, name, hash, admin, created)
+		VALUES (:id, :name, :hash, :admin, :created)`
+	_, err := db.db.NamedExec(query, account)
+	return err
+}
+
+func (db *DB) AccountUpdate(account *Account) error {
+	query := `UPDATE accounts SET name = :name, hash = :hash, admin = :admin
+		WHERE id = :id`
+	res, err := db.db.NamedExec(query, account)
+	return rowsMatched(db.db, res, err, `SELECT COUNT(*) FROM accounts WHERE id = ?`, account.ID)
+}
+
+func (db *DB) AccountGet(name string) (*Account, error) {
+	query := db.db.Rebind(`SELECT id, name, hash, admin, created FROM accounts WHERE name = ?`)
+	var account Account
+	if err := db.db.Get(&account, query, name); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// AccountAll returns all accounts ordered by name.
+func (db *DB) AccountAll() ([]*Account, error) {
+	accounts := []*Account{}
+	query := `SELECT id, name, hash, admin, created FROM accounts ORDER BY name`
+	if err := db.db.Select(&accounts, query); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+///////////////////////////////////////////////////////////
+// subscriptions
+
+// SubscriptionAll returns the ids of the feeds account is subscribed to.
+func (db *DB) SubscriptionAll(account int64) ([]int64, error) {
+	query := db.db.Rebind(`SELECT feed FROM subscriptions WHERE account = ?`)
+	feeds := []int64{}
+	if err := db.db.Select(&feeds, query, account); err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+// SubscriptionSet replaces the subscriptions of account by feeds.
+func (db *DB) SubscriptionSet(account int64, feeds []int64) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(tx.Rebind(`DELETE FROM subscriptions WHERE account = ?`), account); err != nil {
+		return err
+	}
+	insert := tx.Rebind(`INSERT INTO subscriptions(account, feed) VALUES (?, ?)`)
+	seen := make(map[int64]bool)
+	for _, feed := range feeds {
+		if seen[feed] {
+			continue
+		}
+		seen[feed] = true
+		if _, err = tx.Exec(insert, account, feed); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+///////////////////////////////////////////////////////////
+// read state
+
+// ReadStateGet returns what reader has read.
+func (db *DB) ReadStateGet(reader int64) (*ReadState, error) {
+	state := NewReadState()
+	marks := []struct {
+		Feed int64 `db:"feed"`
+		Mark int64 `db:"mark"`
+	}{}
+	query := db.db.Rebind(`SELECT feed, mark FROM read_marks WHERE reader = ?`)
+	if err := db.db.Select(&marks, query, reader); err != nil {
+		return nil, err
+	}
+	for _, mark := range marks {
+		state.Marks[mark.Feed] = mark.Mark
+	}
+	read := []int64{}
+	query = db.db.Rebind(`SELECT post FROM read_posts WHERE reader = ?`)
+	if err := db.db.Select(&read, query, reader); err != nil {
+		return nil, err
+	}
+	for _, post := range read {
+		state.Read[post] = true
+	}
+	return state, nil
+}
+
+// ReadStateMark marks post as read by reader.
+func (db *DB) ReadStateMark(reader int64, post *Post) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	query := tx.Rebind(`SELECT COUNT(*) FROM read_marks WHERE reader = ? AND feed = ? AND mark >= ?`)
+	if err = tx.Get(&n, query, reader, post.Feed, post.ID); err != nil {
+		return err
+	}
+	if n > 0 {
 		return nil
 	}
-	// post content not yet fetched, so we have to do that and update the database
-	return errors.New("Fetching using readability not yet implemented")
+	query = tx.Rebind(`SELECT COUNT(*) FROM read_posts WHERE reader = ? AND post = ?`)
+	if err = tx.Get(&n, query, reader, post.ID); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	query = tx.Rebind(`INSERT INTO read_posts(reader, post, feed) VALUES (?, ?, ?)`)
+	if _, err = tx.Exec(query, reader, post.ID, post.Feed); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReadStateMarkAll marks all posts of feeds with an id up to until as read by
+// reader.
+func (db *DB) ReadStateMarkAll(reader int64, feeds []int64, until int64) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	update := tx.Rebind(`UPDATE read_marks SET mark = ? WHERE reader = ? AND feed = ? AND mark < ?`)
+	exists := tx.Rebind(`SELECT COUNT(*) FROM read_marks WHERE reader = ? AND feed = ?`)
+	insert := tx.Rebind(`INSERT INTO read_marks(reader, feed, mark) VALUES (?, ?, ?)`)
+	forget := tx.Rebind(`DELETE FROM read_posts WHERE reader = ? AND feed = ? AND post <= ?`)
+	for _, feed := range feeds {
+		if _, err = tx.Exec(update, until, reader, feed, until); err != nil {
+			return err
+		}
+		var n int
+		if err = tx.Get(&n, exists, reader, feed); err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err = tx.Exec(insert, reader, feed, until); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.Exec(forget, reader, feed, until); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+///////////////////////////////////////////////////////////
+// saved posts
+
+// SavedAdd saves post for account.
+func (db *DB) SavedAdd(account, post int64) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	query := tx.Rebind(`SELECT COUNT(*) FROM saved WHERE account = ? AND post = ?`)
+	if err = tx.Get(&n, query, account, post); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	query = tx.Rebind(`INSERT INTO saved(account, post) VALUES (?, ?)`)
+	if _, err = tx.Exec(query, account, post); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SavedRemove removes post from the saved posts of account. The post is
+// trimmed as usual once nobody has it saved.
+func (db *DB) SavedRemove(account, post int64) error {
+	query := db.db.Rebind(`DELETE FROM saved WHERE account = ? AND post = ?`)
+	_, err := db.db.Exec(query, account, post)
+	return err
+}
+
+// SavedAll returns the posts account saved, newest first.
+func (db *DB) SavedAll(account int64) ([]*Post, error) {
+	query := db.db.Rebind(`SELECT ` + postColumns + ` FROM posts
+		WHERE id IN (SELECT post FROM saved WHERE account = ?) ORDER BY id DESC`)
+	posts := []*Post{}
+	if err := db.db.Select(&posts, query, account); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// SavedHas reports whether account saved post.
+func (db *DB) SavedHas(account, post int64) (bool, error) {
+	var n int
+	query := db.db.Rebind(`SELECT COUNT(*) FROM saved WHERE account = ? AND post = ?`)
+	if err := db.db.Get(&n, query, account, post); err != nil {
+		return false, err
+	}
+	return n > 0, nil
 }
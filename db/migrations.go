@@ -0,0 +1,415 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Every change to the schema is a migration appended to the list below, the
+// version of a database is the number of migrations applied to it. It is
+// kept in the settings table under the name "version". Migrations are never
+// edited once released, add a new one instead.
+//
+// Data that cannot be moved with plain sql, and changes that have to be made
+// differently per database, are migrated by the optional apply function,
+// which runs after the statements.
+//
+// Column types that differ between the supported databases are written as
+// placeholders and replaced per dialect:
+//
+//	{{id}}     snowflake ids
+//	{{key}}    text that is indexed or unique
+//	{{term}}   short text that is part of a composite key
+//	{{string}} text that defaults to the empty string, existing rows have
+//	           to be updated since mysql gives text no default
+//	{{time}}   nullable timestamps
+//	{{prefix}} length of the index prefix on text, if the database needs one
+type migration struct {
+	description string
+	statements  []string
+	apply       func(tx *sqlx.Tx) error
+}
+
+var migrations = []migration{
+	{
+		"initial schema",
+		[]string{
+			`CREATE TABLE settings (
+				name {{key}} PRIMARY KEY NOT NULL,
+				value TEXT
+			)`,
+			`CREATE TABLE feeds (
+				id {{id}} PRIMARY KEY NOT NULL,
+				handle {{key}} UNIQUE,
+				title TEXT,
+				link TEXT,
+				url {{key}} UNIQUE
+			)`,
+			`CREATE TABLE posts (
+				id {{id}} PRIMARY KEY NOT NULL,
+				title TEXT,
+				guid {{key}} UNIQUE,
+				link TEXT,
+				feed {{id}},
+				time {{time}},
+				content TEXT,
+				FOREIGN KEY(feed) REFERENCES feeds(id)
+			)`,
+			`CREATE TABLE requests (
+				id {{id}} PRIMARY KEY NOT NULL,
+				url TEXT,
+				num INTEGER
+			)`,
+		},
+		nil,
+	},
+	{
+		"feed schedule, validators and health",
+		[]string{
+			`ALTER TABLE feeds ADD COLUMN initialized BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE feeds ADD COLUMN image_url {{string}}`,
+			`ALTER TABLE feeds ADD COLUMN etag {{string}}`,
+			`ALTER TABLE feeds ADD COLUMN last_modified {{string}}`,
+			`ALTER TABLE feeds ADD COLUMN poll_interval BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE feeds ADD COLUMN next_fetch {{time}}`,
+			`ALTER TABLE feeds ADD COLUMN last_success {{time}}`,
+			`ALTER TABLE feeds ADD COLUMN last_error {{string}}`,
+			`ALTER TABLE feeds ADD COLUMN failures INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE feeds ADD COLUMN status INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE feeds ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+			`UPDATE feeds SET image_url = '', etag = '', last_modified = '', last_error = ''
+				WHERE image_url IS NULL`,
+		},
+		nil,
+	},
+	{
+		"post fingerprints and request dates",
+		[]string{
+			`ALTER TABLE posts ADD COLUMN fingerprint {{key}} NOT NULL DEFAULT ''`,
+			`CREATE INDEX posts_fingerprint ON posts(fingerprint)`,
+			`ALTER TABLE requests ADD COLUMN time {{time}}`,
+			`UPDATE requests SET time = CURRENT_TIMESTAMP WHERE time IS NULL`,
+			`CREATE UNIQUE INDEX requests_url ON requests(url{{prefix}})`,
+		},
+		nil,
+	},
+	{
+		"search index",
+		[]string{
+			`CREATE TABLE terms (
+				term {{term}} NOT NULL,
+				post {{id}} NOT NULL,
+				PRIMARY KEY(term, post)
+			)`,
+			`CREATE INDEX terms_post ON terms(post)`,
+		},
+		indexAllPosts,
+	},
+	{
+		"feed categories",
+		[]string{
+			`ALTER TABLE feeds ADD COLUMN category {{string}}`,
+			`UPDATE feeds SET category = '' WHERE category IS NULL`,
+		},
+		nil,
+	},
+	{
+		"feed request moderation",
+		[]string{
+			`ALTER TABLE requests ADD COLUMN status {{string}}`,
+			`ALTER TABLE requests ADD COLUMN decided_by {{string}}`,
+			`ALTER TABLE requests ADD COLUMN decided_at {{time}}`,
+			`ALTER TABLE requests ADD COLUMN handle {{string}}`,
+			`UPDATE requests SET status = '', decided_by = '', handle = '' WHERE status IS NULL`,
+		},
+		nil,
+	},
+	{
+		"accounts",
+		[]string{
+			`CREATE TABLE accounts (
+				id {{id}} PRIMARY KEY NOT NULL,
+				name {{key}} UNIQUE NOT NULL,
+				hash {{string}},
+				admin BOOLEAN NOT NULL DEFAULT FALSE,
+				created {{time}}
+			)`,
+		},
+		nil,
+	},
+	{
+		"subscriptions",
+		[]string{
+			`CREATE TABLE subscriptions (
+				account {{id}} NOT NULL,
+				feed {{id}} NOT NULL,
+				PRIMARY KEY(account, feed)
+			)`,
+			`CREATE INDEX subscriptions_feed ON subscriptions(feed)`,
+		},
+		nil,
+	},
+	{
+		"read state",
+		[]string{
+			`CREATE TABLE read_marks (
+				reader {{id}} NOT NULL,
+				feed {{id}} NOT NULL,
+				mark {{id}} NOT NULL,
+				PRIMARY KEY(reader, feed)
+			)`,
+			`CREATE TABLE read_posts (
+				reader {{id}} NOT NULL,
+				post {{id}} NOT NULL,
+				feed {{id}} NOT NULL,
+				PRIMARY KEY(reader, post)
+			)`,
+			`CREATE INDEX read_posts_post ON read_posts(post)`,
+		},
+		nil,
+	},
+	{
+		"saved posts",
+		[]string{
+			`CREATE TABLE saved (
+				account {{id}} NOT NULL,
+				post {{id}} NOT NULL,
+				PRIMARY KEY(account, post)
+			)`,
+			`CREATE INDEX saved_post ON saved(post)`,
+		},
+		nil,
+	},
+	{
+		"article prefetching",
+		[]string{
+			`ALTER TABLE feeds ADD COLUMN prefetch BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+		nil,
+	},
+	{
+		"article metadata",
+		[]string{
+			`ALTER TABLE posts ADD COLUMN meta TEXT`,
+		},
+		nil,
+	},
+	{
+		"post guids unique per feed",
+		nil,
+		scopePostGUIDs,
+	},
+}
+
+// scopePostGUIDs replaces the unique constraint on posts.guid by one on feed
+// and guid. The constraint was declared with the column, so how to get rid of
+// it depends on the database.
+func scopePostGUIDs(tx *sqlx.Tx) error {
+	var statements []string
+	switch tx.DriverName() {
+	case "sqlite3":
+		// sqlite can not drop constraints, the table is rebuilt instead
+		statements = []string{
+			`CREATE TABLE posts_scoped (
+				id BIGINT PRIMARY KEY NOT NULL,
+				title TEXT,
+				guid TEXT,
+				link TEXT,
+				feed BIGINT,
+				time TIMESTAMP,
+				content TEXT,
+				fingerprint TEXT NOT NULL DEFAULT '',
+				meta TEXT,
+				FOREIGN KEY(feed) REFERENCES feeds(id)
+			)`,
+			`INSERT INTO posts_scoped(id, title, guid, link, feed, time, content, fingerprint, meta)
+				SELECT id, title, guid, link, feed, time, content, fingerprint, meta FROM posts`,
+			`DROP TABLE posts`,
+			`ALTER TABLE posts_scoped RENAME TO posts`,
+			`CREATE INDEX posts_fingerprint ON posts(fingerprint)`,
+			`CREATE UNIQUE INDEX posts_feed_guid ON posts(feed, guid)`,
+		}
+	case "postgres":
+		statements = []string{
+			`ALTER TABLE posts DROP CONSTRAINT posts_guid_key`,
+			`CREATE UNIQUE INDEX posts_feed_guid ON posts(feed, guid)`,
+		}
+	case "mymysql":
+		// a unique prefix would reject distinct guids sharing it, PostAddBatch
+		// checks for duplicates anyway
+		statements = []string{
+			`ALTER TABLE posts DROP INDEX guid`,
+			`CREATE INDEX posts_feed_guid ON posts(feed, guid(191))`,
+		}
+	default:
+		return fmt.Errorf("unsupported database %s", tx.DriverName())
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialects maps the driver names to the column types used in migrations.
+var dialects = map[string]map[string]string{
+	"sqlite3": {
+		"{{id}}":     "BIGINT",
+		"{{key}}":    "TEXT",
+		"{{term}}":   "TEXT",
+		"{{string}}": "TEXT NOT NULL DEFAULT ''",
+		"{{time}}":   "TIMESTAMP",
+		"{{prefix}}": "",
+	},
+	"postgres": {
+		"{{id}}":     "BIGINT",
+		"{{key}}":    "TEXT",
+		"{{term}}":   "TEXT",
+		"{{string}}": "TEXT NOT NULL DEFAULT ''",
+		"{{time}}":   "TIMESTAMP",
+		"{{prefix}}": "",
+	},
+	// mysql can neither index unbounded text nor give it a default, and keys
+	// are limited to 3072 bytes, 768 characters in utf8mb4
+	"mymysql": {
+		"{{id}}":     "BIGINT",
+		"{{key}}":    "VARCHAR(768)",
+		"{{term}}":   "VARCHAR(191)",
+		"{{string}}": "TEXT",
+		"{{time}}":   "DATETIME(6) NULL",
+		"{{prefix}}": "(768)",
+	},
+}
+
+// SchemaVersion is the version of the newest schema known.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func (db *DB) dialect() (map[string]string, error) {
+	types, ok := dialects[db.db.DriverName()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database %s", db.db.DriverName())
+	}
+	return types, nil
+}
+
+// Version returns the schema version of the database, 0 if it is empty.
+func (db *DB) Version() (int, error) {
+	// without a settings table nothing was ever created
+	exists, err := db.hasTable("settings")
+	if err != nil || !exists {
+		return 0, err
+	}
+	value, err := db.SettingGet("version")
+	if err == nil {
+		return strconv.Atoi(value)
+	}
+	if err != ErrNotFound {
+		return 0, err
+	}
+	// databases created before migrations existed have a settings table
+	// without a version
+	return 1, nil
+}
+
+// hasTable reports whether the database has a table called name.
+func (db *DB) hasTable(name string) (bool, error) {
+	var query string
+	switch db.db.DriverName() {
+	case "sqlite3":
+		query = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	case "postgres":
+		query = `SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name = ?`
+	case "mymysql":
+		query = `SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_name = ?`
+	default:
+		return false, fmt.Errorf("unsupported database %s", db.db.DriverName())
+	}
+	var n int
+	if err := db.db.Get(&n, db.db.Rebind(query), name); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Migrate applies all migrations the database is missing, each in its own
+// transaction. It returns the version the database was on before.
+func (db *DB) Migrate() (int, error) {
+	types, err := db.dialect()
+	if err != nil {
+		return 0, err
+	}
+	from, err := db.Version()
+	if err != nil {
+		return 0, err
+	}
+	if from > SchemaVersion() {
+		return from, fmt.Errorf("database schema version %d is newer than this program (%d)", from, SchemaVersion())
+	}
+
+	for version := from + 1; version <= SchemaVersion(); version += 1 {
+		if err := db.migrate(version, types); err != nil {
+			return from, fmt.Errorf("migration %d (%s): %s", version, migrations[version-1].description, err.Error())
+		}
+	}
+	return from, nil
+}
+
+func (db *DB) migrate(version int, types map[string]string) error {
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range migrations[version-1].statements {
+		for placeholder, replacement := range types {
+			statement = strings.Replace(statement, placeholder, replacement, -1)
+		}
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if apply := migrations[version-1].apply; apply != nil {
+		if err := apply(tx); err != nil {
+			return err
+		}
+	}
+
+	value := strconv.Itoa(version)
+	update := tx.Rebind(`UPDATE settings SET value = ? WHERE name = 'version'`)
+	err = rowsAffected(tx.Exec(update, value))
+	if err == ErrNotFound {
+		insert := tx.Rebind(`INSERT INTO settings(name, value) VALUES ('version', ?)`)
+		_, err = tx.Exec(insert, value)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkVersion fails unless the schema of the database is up to date.
+func (db *DB) checkVersion() error {
+	version, err := db.Version()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == 0:
+		return errors.New("database is empty, run init first")
+	case version < SchemaVersion():
+		return fmt.Errorf("database schema version %d is outdated, run migrate sql", version)
+	case version > SchemaVersion():
+		return fmt.Errorf("database schema version %d is newer than this program (%d)", version, SchemaVersion())
+	}
+	return nil
+}
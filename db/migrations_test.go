@@ -0,0 +1,190 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// baselineSchema is the schema databases had before migrations existed.
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS settings (
+	name TEXT PRIMARY KEY UNIQUE,
+	value TEXT
+);
+CREATE TABLE IF NOT EXISTS feeds (
+	id INTEGER PRIMARY KEY NOT NULL,
+	handle TEXT UNIQUE,
+	title TEXT,
+	link TEXT,
+	url TEXT UNIQUE
+);
+CREATE TABLE IF NOT EXISTS posts (
+	id INTEGER PRIMARY KEY NOT NULL,
+	title TEXT,
+	guid TEXT UNIQUE,
+	link TEXT,
+	feed INTEGER,
+	time DATETIME,
+	content TEXT,
+	FOREIGN KEY(feed) REFERENCES feeds(id)
+);
+CREATE TABLE IF NOT EXISTS requests (
+	id INTEGER PRIMARY KEY NOT NULL,
+	url TEXT,
+	num INTEGER
+);
+`
+
+func openTestDB(t *testing.T) *DB {
+	db, err := Open("sqlite3://" + filepath.Join(t.TempDir(), "news.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrateEmpty(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Disconnect()
+
+	if version, err := db.Version(); err != nil || version != 0 {
+		t.Fatalf("empty database has version %d (%v), want 0", version, err)
+	}
+	if err := db.checkVersion(); err == nil {
+		t.Errorf("checkVersion accepted an empty database")
+	}
+	from, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 {
+		t.Errorf("Migrate started from version %d, want 0", from)
+	}
+	if version, err := db.Version(); err != nil || version != SchemaVersion() {
+		t.Fatalf("migrated database has version %d (%v), want %d", version, err, SchemaVersion())
+	}
+	if err := db.checkVersion(); err != nil {
+		t.Error(err)
+	}
+
+	// migrating an up to date database does nothing
+	if from, err = db.Migrate(); err != nil || from != SchemaVersion() {
+		t.Errorf("second Migrate started from version %d (%v), want %d", from, err, SchemaVersion())
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Disconnect()
+
+	if _, err := db.db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	fixtures := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO feeds(id, handle, url) VALUES (?, ?, ?)`, []interface{}{1, "bbc", "http://bbc.example/rss"}},
+		{`INSERT INTO feeds(id, handle, title, url) VALUES (?, ?, ?, ?)`, []interface{}{2, "csm", "Monitor", "http://csm.example/rss"}},
+		{`INSERT INTO posts(id, title, guid, link, feed, time, content) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			[]interface{}{10, "Elections held", "http://bbc.example/1", "http://bbc.example/1", 1, date, "<p>votes</p>"}},
+		{`INSERT INTO posts(id, title, guid, link, feed, time) VALUES (?, ?, ?, ?, ?, ?)`,
+			[]interface{}{11, "Markets rally", "http://csm.example/1", "http://csm.example/1", 2, date}},
+		{`INSERT INTO requests(id, url, num) VALUES (?, ?, ?)`, []interface{}{20, "http://wanted.example/rss", 3}},
+	}
+	for _, fixture := range fixtures {
+		if _, err := db.db.Exec(fixture.query, fixture.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if version, err := db.Version(); err != nil || version != 1 {
+		t.Fatalf("baseline database has version %d (%v), want 1", version, err)
+	}
+	from, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 {
+		t.Errorf("Migrate started from version %d, want 1", from)
+	}
+	if version, err := db.Version(); err != nil || version != SchemaVersion() {
+		t.Fatalf("migrated database has version %d (%v), want %d", version, err, SchemaVersion())
+	}
+
+	// columns added later read as empty for existing rows
+	feeds, err := db.FeedAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 2 || feeds[0].Handle != "bbc" || feeds[0].Title != "" || feeds[1].Title != "Monitor" {
+		t.Fatalf("FeedAll returned %+v", feeds)
+	}
+	if feeds[0].ETag != "" || feeds[0].Category != "" || !feeds[0].NextFetch.IsZero() || feeds[0].Prefetch {
+		t.Errorf("new columns of an old feed are not empty: %+v", feeds[0])
+	}
+
+	post, err := db.PostGet(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.GUID != "http://bbc.example/1" || post.Feed != 1 || post.Fingerprint != "" {
+		t.Errorf("PostGet returned %+v", post)
+	}
+	if err := db.PostFetchContent(post); err != nil || post.Content != "<p>votes</p>" || post.Meta != "" {
+		t.Errorf("content of an old post: %q, %q (%v)", post.Content, post.Meta, err)
+	}
+	if err := db.PostFetchContent(&Post{ID: 11}); err != ErrNoContent {
+		t.Errorf("post without content: PostFetchContent returned %v, want ErrNoContent", err)
+	}
+
+	// the search index was built for existing posts
+	q, err := ParseQuery("markets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := db.PostSearch(q, 10, 1<<63-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != 11 {
+		t.Errorf("search for markets found %+v", found)
+	}
+
+	reqs, err := db.RequestAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || !reqs[0].Pending() || reqs[0].N != 3 || reqs[0].Date.IsZero() {
+		t.Errorf("RequestAll returned %+v", reqs)
+	}
+
+	// guids are now unique per feed only
+	inserted, err := db.PostAddBatch([]*Post{{ID: 12, Title: "Elsewhere", GUID: "http://bbc.example/1", Feed: 2, Date: date}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 1 {
+		t.Errorf("post with the guid of another feed was not inserted")
+	}
+}
+
+func TestVersionError(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	conn := db.db
+	db.Disconnect()
+	db.db = conn
+
+	// a database that can not be read is not mistaken for an empty one
+	if version, err := db.Version(); err == nil {
+		t.Errorf("Version of a closed database returned %d without an error", version)
+	}
+	if _, err := db.Migrate(); err == nil {
+		t.Errorf("Migrate of a closed database succeeded")
+	}
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search works on terms, the lowercased words of the title of a post, the
+// title of its feed and its extracted article content. Both backends keep an
+// index from terms to posts and check phrases against the text itself.
+
+// maxTermLength keeps index keys bounded, longer words are cut.
+const maxTermLength = 64
+
+var tagRE = regexp.MustCompile(`<[^>]*>`)
+
+// Tokenize splits text into lowercased words, html tags are skipped.
+func Tokenize(text string) []string {
+	text = html.UnescapeString(tagRE.ReplaceAllString(text, " "))
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		if runes := []rune(word); len(runes) > maxTermLength {
+			words[i] = string(runes[:maxTermLength])
+		}
+	}
+	return words
+}
+
+// Terms returns the distinct terms of all texts.
+func Terms(texts ...string) []string {
+	seen := make(map[string]bool)
+	terms := []string{}
+	for _, text := range texts {
+		for _, term := range Tokenize(text) {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+// Query is a parsed search query. All terms and phrases must match.
+type Query struct {
+	Terms   []string   // includes the words of all phrases
+	Phrases [][]string // words that must follow each other
+	Feeds   []string   // handles of the feeds to search, empty for all
+	After   time.Time  // zero for no lower bound
+	Before  time.Time  // zero for no upper bound
+}
+
+// ParseQuery understands words, "quoted phrases", feed:<handle> to restrict
+// the search to a feed (may be given multiple times) and after:<date> and
+// before:<date> with dates formatted as 2006-01-02.
+func ParseQuery(s string) (*Query, error) {
+	q := &Query{}
+	seen := make(map[string]bool)
+	addTerms := func(words []string) {
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				q.Terms = append(q.Terms, word)
+			}
+		}
+	}
+
+	// phrases first, what remains are single words and filters
+	parts := strings.Split(s, `"`)
+	for i := 1; i < len(parts); i += 2 {
+		words := Tokenize(parts[i])
+		if len(words) > 1 {
+			q.Phrases = append(q.Phrases, words)
+		}
+		addTerms(words)
+	}
+	for i := 0; i < len(parts); i += 2 {
+		for _, field := range strings.Fields(parts[i]) {
+			var err error
+			switch {
+			case strings.HasPrefix(field, "feed:"):
+				q.Feeds = append(q.Feeds, strings.TrimPrefix(field, "feed:"))
+			case strings.HasPrefix(field, "after:"):
+				q.After, err = time.Parse("2006-01-02", strings.TrimPrefix(field, "after:"))
+			case strings.HasPrefix(field, "before:"):
+				q.Before, err = time.Parse("2006-01-02", strings.TrimPrefix(field, "before:"))
+			default:
+				addTerms(Tokenize(field))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid date in %s, expected YYYY-MM-DD", field)
+			}
+		}
+	}
+	return q, nil
+}
+
+// Empty reports whether the query would match every post.
+func (q *Query) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Feeds) == 0 && q.After.IsZero() && q.Before.IsZero()
+}
+
+// MatchDate reports whether t lies within the date range of the query.
+func (q *Query) MatchDate(t time.Time) bool {
+	return (q.After.IsZero() || !t.Before(q.After)) && (q.Before.IsZero() || t.Before(q.Before))
+}
+
+// MatchPhrases reports whether every phrase of the query appears in one of
+// the texts.
+func (q *Query) MatchPhrases(texts ...string) bool {
+	if len(q.Phrases) == 0 {
+		return true
+	}
+	tokenized := make([][]string, len(texts))
+	for i, text := range texts {
+		tokenized[i] = Tokenize(text)
+	}
+	for _, phrase := range q.Phrases {
+		found := false
+		for _, words := range tokenized {
+			found = found || containsPhrase(words, phrase)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPhrase(words, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(words); i += 1 {
+		match := true
+		for j := range phrase {
+			if words[i+j] != phrase[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -1,148 +1,503 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"sync"
 	"time"
 
-	"github.com/alexander-matz/go-news/db"
 	"github.com/SlyMarbo/rss"
+
+	"github.com/alexander-matz/go-news/db"
 )
 
 type FeedD struct {
-	stop   chan bool
 	active bool
-	store  *Store
+	store  Storage
 	log    *log.Logger
-	seen   map[string]bool
+	client *http.Client
+
+	// number of feeds fetched concurrently
+	workers int
+	// number of consecutive failures after which a feed is disabled, 0 to
+	// never disable feeds
+	maxFailures int
+
+	cancel  context.CancelFunc
+	done    chan bool
+	refresh chan bool
+
+	// guarded by tlock
+	timings    FeedDTimings
+	refreshIDs []int64
+	refreshAll bool
+	tlock      sync.Mutex
+}
+
+// FeedDTimings describes the recent work of the crawler.
+type FeedDTimings struct {
+	Fetches   int           // fetches since the start
+	Failures  int           // failed fetches since the start
+	LastFetch time.Time     // completion of the last fetch
+	Last      time.Duration // duration of the last fetch
+	Average   time.Duration // moving average of the fetch duration
+	Max       time.Duration // longest fetch since the start
+	Scheduled int           // feeds waiting in the queue
+	Pending   int           // feeds being fetched
+	NextFetch time.Time     // next feed due, zero if none
 }
 
-func NewFeedD(store *Store, log *log.Logger) *FeedD {
-	res := &FeedD{make(chan bool), false, store, log, nil}
+func NewFeedD(store Storage, workers int, timeout time.Duration, maxFailures int, log *log.Logger) *FeedD {
+	res := &FeedD{}
+	res.store = store
+	res.log = log
+	res.client = &http.Client{Timeout: timeout}
+	res.workers = workers
+	res.maxFailures = maxFailures
+	res.refresh = make(chan bool, 1)
 	return res
 }
 
-func (f *FeedD) MaxFeeds() int {
-	return MaxIDGen - 256
+// Timings returns a snapshot of the crawler's timings.
+func (f *FeedD) Timings() FeedDTimings {
+	f.tlock.Lock()
+	defer f.tlock.Unlock()
+	return f.timings
+}
+
+// Refresh makes the given feeds, or all feeds if none are given, due now.
+func (f *FeedD) Refresh(ids ...int64) {
+	f.tlock.Lock()
+	if len(ids) == 0 {
+		f.refreshAll = true
+	}
+	f.refreshIDs = append(f.refreshIDs, ids...)
+	f.tlock.Unlock()
+	select {
+	case f.refresh <- true:
+	default:
+		// already signalled
+	}
+}
+
+// takeRefresh returns the feeds to refresh, or nil for all.
+func (f *FeedD) takeRefresh() []int64 {
+	f.tlock.Lock()
+	defer f.tlock.Unlock()
+	ids := f.refreshIDs
+	if f.refreshAll {
+		ids = nil
+	}
+	f.refreshIDs = nil
+	f.refreshAll = false
+	return ids
+}
+
+// record updates the timings with a completed fetch.
+func (f *FeedD) record(res *fetchResult, queue *feedQueue, pending int) {
+	f.tlock.Lock()
+	defer f.tlock.Unlock()
+	t := &f.timings
+	if res != nil {
+		t.Fetches += 1
+		if res.failed {
+			t.Failures += 1
+		}
+		t.LastFetch = time.Now()
+		t.Last = res.took
+		if t.Average == 0 {
+			t.Average = res.took
+		} else {
+			t.Average = (t.Average*9 + res.took) / 10
+		}
+		if res.took > t.Max {
+			t.Max = res.took
+		}
+	}
+	t.Scheduled = queue.Len()
+	t.Pending = pending
+	t.NextFetch, _ = queue.Next()
 }
 
 func (f *FeedD) Start() error {
 	if f.active {
 		return errors.New("already running")
 	}
-
-	var err error
-	f.seen, err = f.store.PostsGUIDMap()
-	if err != nil {
-		return err
+	// every worker needs its own id generator, subsystems below 256 are
+	// reserved for everything else
+	if f.workers < 1 || f.workers > MaxIDGen-256 {
+		return fmt.Errorf("number of workers must be between 1 and %d", MaxIDGen-256)
 	}
+
+	var ctx context.Context
+	ctx, f.cancel = context.WithCancel(context.Background())
+	f.done = make(chan bool)
 	f.active = true
-	go f.run()
+	go f.run(ctx)
 	return nil
 }
 
+// Stop cancels all fetches in flight and waits for the workers to finish.
 func (f *FeedD) Stop() {
 	if f.active {
-		f.stop <- true
+		f.cancel()
+		<-f.done
 		f.active = false
 	}
 }
 
-func (f *FeedD) run() {
+// fetchResult carries the outcome of polling a single feed back to run.
+type fetchResult struct {
+	feed   int64
+	next   time.Time
+	posts  []*Post
+	took   time.Duration
+	failed bool
+}
+
+func (f *FeedD) run(ctx context.Context) {
+	defer close(f.done)
+
 	select {
-	case <-f.stop:
+	case <-ctx.Done():
 		return
 	case <-time.After(time.Second * 2):
 		break
 	}
+
+	jobs := make(chan *Feed, f.workers)
+	results := make(chan *fetchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < f.workers; i += 1 {
+		wg.Add(1)
+		go f.work(ctx, NewIDGen(256+i), jobs, results, &wg)
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	queue := newFeedQueue()
+	pending := make(map[int64]bool)
+	feeds := make(map[int64]*Feed)
+
+	// feeds are reloaded once a minute to pick up new and changed feeds, and
+	// whenever a refresh is requested
+	reload := true
+	reloadTick := time.NewTicker(time.Minute)
+	defer reloadTick.Stop()
+
 	for true {
-		delay := time.After(time.Minute * 5)
+		if reload {
+			if all, err := f.store.FeedAll(); err != nil {
+				f.log.Printf("ERROR: loading feeds: %s", err.Error())
+			} else {
+				feeds = make(map[int64]*Feed)
+				for _, feed := range all {
+					feeds[feed.ID] = feed
+				}
+				f.sync(queue, feeds, pending)
+				reload = false
+			}
+		}
 
-		f.log.Printf("updating")
-		feeds := f.store.FeedsAll()
-		if len(feeds) > f.MaxFeeds() {
-			f.log.Printf("WARNING: too many feeds, ignoring some")
-			feeds = feeds[:f.MaxFeeds()]
+		now := time.Now()
+		for _, id := range queue.PopDue(now, f.workers-len(pending)) {
+			pending[id] = true
+			jobs <- feeds[id]
 		}
-		posts := make(chan *Post)
-		for i, feed := range feeds {
-			idgen := NewIDGen(256 + i)
-			go f.fetch(feed, idgen, posts)
+		f.record(nil, queue, len(pending))
+
+		// wake up when the next feed is due, unless all workers are busy
+		// anyway
+		var wake <-chan time.Time
+		if next, ok := queue.Next(); ok && len(pending) < f.workers {
+			wake = time.After(next.Sub(now))
 		}
-		newposts := make([]*Post, 0)
-		newmap := make(map[string]bool)
-		_ = newposts
-		_ = newmap
-		remain := len(feeds)
-		numnew := 0
-		for remain > 0 {
-			post := <-posts
-			if post == nil {
-				remain -= 1
-				continue
+
+		select {
+		case <-ctx.Done():
+			return
+		case res := <-results:
+			delete(pending, res.feed)
+			// only the fetched feed changed, its validators and state are
+			// picked up without reloading all feeds
+			feed, err := f.store.FeedGet(res.feed)
+			if err == nil && !feed.Disabled {
+				feeds[res.feed] = feed
+				queue.Schedule(res.feed, res.next)
+			} else if err == nil || err == db.ErrNotFound {
+				delete(feeds, res.feed)
+			} else {
+				f.log.Printf("ERROR: loading feed: %s", err.Error())
+				queue.Schedule(res.feed, res.next)
+			}
+			f.insert(res)
+			f.record(res, queue, len(pending))
+		case <-reloadTick.C:
+			reload = true
+		case <-f.refresh:
+			reload = true
+			ids := f.takeRefresh()
+			if ids == nil {
+				ids = queue.IDs()
 			}
-			newposts = append(newposts, post)
-			newmap[post.GUID] = true
-			numnew += 1
+			for _, id := range ids {
+				if queue.Contains(id) {
+					queue.Schedule(id, now)
+				}
+			}
+		case <-wake:
+			break
+		}
+	}
+}
+
+// work fetches feeds from jobs until jobs is closed or ctx is cancelled.
+func (f *FeedD) work(ctx context.Context, ids *IDGen, jobs chan *Feed, results chan *fetchResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for feed := range jobs {
+		res := f.fetch(ctx, feed, ids)
+		if res == nil {
+			continue
 		}
-		close(posts)
-		f.seen = newmap
-		f.store.PostsInsert(newposts)
-		f.log.Printf("%d new posts", numnew)
 		select {
-		case <-f.stop:
-			return
-		case <-delay:
+		case results <- res:
 			break
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync schedules feeds that were added to the store since the last call and
+// forgets about feeds that were removed.
+func (f *FeedD) sync(queue *feedQueue, feeds map[int64]*Feed, pending map[int64]bool) {
+	for _, id := range queue.IDs() {
+		if feed, ok := feeds[id]; !ok || feed.Disabled {
+			queue.Remove(id)
+		}
+	}
+	for id, feed := range feeds {
+		if !feed.Disabled && !pending[id] && !queue.Contains(id) {
+			queue.Schedule(id, feed.NextFetch)
 		}
 	}
 }
 
-func (f *FeedD) fetch(ref *Feed, ids *IDGen, pc chan *Post) {
+// insert stores the posts of a fetch, the store takes care of skipping the
+// ones it already knows. Posts of feeds removed while they were fetched are
+// dropped, new posts of feeds with prefetching enabled are handed to the
+// prefetcher.
+func (f *FeedD) insert(res *fetchResult) {
+	if len(res.posts) == 0 {
+		return
+	}
+	feed, err := f.store.FeedGet(res.feed)
+	if err == db.ErrNotFound {
+		return
+	}
+	newposts, err := f.store.PostAddBatch(res.posts)
+	if err != nil {
+		f.log.Printf("ERROR: inserting posts: %s", err.Error())
+		return
+	}
+	if len(newposts) > 0 {
+		f.log.Printf("%d new posts", len(newposts))
+	}
+	if stats != nil {
+		stats.AddPosts(len(newposts))
+	}
+	if prefetcher != nil && feed != nil && feed.Prefetch {
+		prefetcher.Enqueue(newposts)
+	}
+}
+
+// fetch polls a single feed and updates its schedule and health. It returns
+// nil if ctx was cancelled before the fetch completed.
+func (f *FeedD) fetch(ctx context.Context, ref *Feed, ids *IDGen) *fetchResult {
+	res := &fetchResult{feed: ref.ID}
+	maxAge := PostsMaxAge()
+	start := time.Now()
 	defer func() {
-		pc <- nil
+		res.took = time.Since(start)
 	}()
-	maxAge := f.store.PostsMaxAge()
 
-	feed, err := rss.Fetch(ref.URL)
+	newFeed := *ref
+	resp, err := f.download(ctx, ref)
+	if ctx.Err() != nil {
+		// shutting down, this is not the feed's fault
+		return nil
+	}
+	if resp != nil {
+		newFeed.Status = resp.status
+	}
 	if err != nil {
 		f.log.Printf("ERROR: feed %s: %s", ref.Handle, err.Error())
-		return
-	}
-	if !ref.Initialized {
-		newFeed := &Feed{ref.ID, true, ref.Handle, feed.Title, feed.Link, ref.URL, feed.Image.Url}
-		f.store.FeedsSet(newFeed)
-	}
-	feedID := ref.ID
-	for _, post := range feed.Items {
-		guid := post.Link
-		link := post.Link
-		date := post.Date
-		if date.IsZero() {
-			date = time.Now()
+		newFeed.LastError = err.Error()
+		newFeed.Failures += 1
+		newFeed.NextFetch = time.Now().Add(backoffInterval(ref.Interval, newFeed.Failures))
+		if f.maxFailures > 0 && newFeed.Failures >= f.maxFailures {
+			f.log.Printf("WARNING: feed %s failed %d times, disabling", ref.Handle, newFeed.Failures)
+			newFeed.Disabled = true
 		}
-		id := ids.MakeIDFromTimestamp(date)
-		title := post.Title
+		f.update(&newFeed)
+		res.next = newFeed.NextFetch
+		res.failed = true
+		return res
+	}
+	newFeed.LastSuccess = time.Now()
+	newFeed.LastError = ""
+	newFeed.Failures = 0
 
-		if f.seen[guid] {
-			continue
+	var dates []time.Time
+	if feed := resp.feed; feed != nil {
+		if !ref.Initialized {
+			newFeed.Initialized = true
+			newFeed.Title = feed.Title
+			newFeed.Link = feed.Link
+			if feed.Image != nil {
+				newFeed.ImageURL = feed.Image.Url
+			}
 		}
+		dates = make([]time.Time, 0, len(feed.Items))
+		for _, post := range feed.Items {
+			dates = append(dates, post.Date)
 
-		if date.Before(maxAge) {
-			continue
+			content := post.Content
+			if content == "" {
+				content = post.Summary
+			}
+			fingerprint := PostFingerprint(post.Title, post.Link, content)
+			guid := PostGUID(post.ID, post.Link, fingerprint)
+			link := post.Link
+			date := post.Date
+			if date.IsZero() {
+				date = time.Now()
+			}
+			id := ids.MakeIDFromTimestamp(date)
+			title := post.Title
+
+			if date.Before(maxAge) {
+				continue
+			}
+
+			var p Post
+			p.ID = id
+			p.Title = title
+			p.GUID = guid
+			p.Fingerprint = fingerprint
+			p.Link = link
+			p.Feed = ref.ID
+			p.Date = date
+			res.posts = append(res.posts, &p)
 		}
+	}
+	newFeed.ETag = resp.etag
+	newFeed.LastModified = resp.lastModified
+	newFeed.Interval = pollInterval(ref.Interval, dates, resp.hint)
+	newFeed.NextFetch = time.Now().Add(newFeed.Interval)
+	f.update(&newFeed)
 
-		var p Post
-		p.ID = id
-		p.Title = title
-		p.GUID = guid
-		p.Link = link
-		p.Feed = feedID
-		p.Date = date
-		pc <- &p
+	res.next = newFeed.NextFetch
+	return res
+}
+
+// Probe downloads and parses the feed at url without storing anything.
+func (f *FeedD) Probe(ctx context.Context, url string) (*rss.Feed, error) {
+	resp, err := f.download(ctx, &Feed{URL: url})
+	if err != nil {
+		return nil, err
+	}
+	if resp.feed == nil {
+		return nil, errors.New("no feed returned")
 	}
+	return resp.feed, nil
 }
 
-func updateFeeds(db *db.DB, feeds []*db.Feed) error {
-	return nil
+// update stores the outcome of a fetch. Settings changed while the feed was
+// fetched are kept.
+func (f *FeedD) update(feed *Feed) {
+	current, err := f.store.FeedGet(feed.ID)
+	if err == db.ErrNotFound {
+		// removed while it was fetched
+		return
+	} else if err == nil {
+		feed.Handle = current.Handle
+		feed.URL = current.URL
+		feed.Category = current.Category
+		feed.Disabled = feed.Disabled || current.Disabled
+		feed.Prefetch = current.Prefetch
+		if current.Initialized {
+			feed.Title = current.Title
+		}
+	}
+	if err := f.store.FeedUpdate(feed); err == db.ErrNotFound {
+		return
+	} else if err != nil {
+		f.log.Printf("ERROR: updating feed %s: %s", feed.Handle, err.Error())
+	}
+}
+
+// response is the result of downloading a feed document.
+type response struct {
+	status       int
+	feed         *rss.Feed // nil if not modified
+	etag         string
+	lastModified string
+	hint         time.Duration // minimum polling interval requested
+}
+
+// download fetches and parses the document behind ref.URL. The validators
+// remembered from the previous fetch are sent along, and if the server
+// answers with 304 Not Modified the returned feed is nil. The validators of
+// the response are returned so they can be stored with the feed. If the
+// server answered at all, the response is returned even on errors so the
+// status code can be recorded.
+func (f *FeedD) download(ctx context.Context, ref *Feed) (*response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ref.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ref.ETag != "" {
+		req.Header.Set("If-None-Match", ref.ETag)
+	}
+	if ref.LastModified != "" {
+		req.Header.Set("If-Modified-Since", ref.LastModified)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resp := &response{status: res.StatusCode}
+	if res.StatusCode == http.StatusNotModified {
+		resp.etag = ref.ETag
+		resp.lastModified = ref.LastModified
+		resp.hint = cacheMaxAge(res.Header)
+		return resp, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	resp.feed, err = rss.Parse(body)
+	if err != nil {
+		return resp, err
+	}
+	resp.etag = res.Header.Get("ETag")
+	resp.lastModified = res.Header.Get("Last-Modified")
+	resp.hint = feedHints(body)
+	if maxAge := cacheMaxAge(res.Header); maxAge > resp.hint {
+		resp.hint = maxAge
+	}
+	return resp, nil
 }
@@ -1,17 +1,21 @@
 package main
 
 import (
-	_ "crypto/subtle"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net/http"
 	"net/http/pprof"
 	_ "net/url"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alexander-matz/go-news/db"
@@ -25,48 +29,91 @@ var (
 	logger *log.Logger
 
 	// command line interface
-	app       = kingpin.New("go-news", "A less distracting RSS reader.")
-	appDbPath = app.Flag("db-path", "Path to the database file.").Short('d').Default("./data.bolt").String()
-	appDbUri  = app.Flag("db-conn", "Database connection string.").Short('c').Default("sqlite3://./data.etilqs").String()
-	appDebug  = app.Flag("debug", "Enable debug mode.").Default("false").Bool()
+	app      = kingpin.New("go-news", "A less distracting RSS reader.")
+	appDbUri = app.Flag("db-conn", "Storage uri: bolt://<path>, sqlite3://<path>, postgres://<user>@<host>/<database> or mysql://tcp:<host>:<port>*<database>/<user>/<password>.").Short('c').Default("sqlite3://./data.etilqs").String()
+	appDebug = app.Flag("debug", "Enable debug mode.").Default("false").Bool()
 
 	serve            = app.Command("serve", "Run the server.")
 	serveBaseUrl     = serve.Flag("base-url", "Required if go-news runs in a subdirectory.").Short('b').Default("").String()
 	serveBindAddress = serve.Flag("address", "Binding Address.").Short('a').Default(":8080").String()
 	servePerPage     = serve.Flag("per-page", "News items per page.").Default("25").Int()
 	serveProfile     = serve.Flag("profile", "Enable profiling.").Default("false").Bool()
+	serveWorkers     = serve.Flag("workers", "Number of feeds fetched concurrently.").Default("8").Int()
+	serveTimeout     = serve.Flag("fetch-timeout", "Timeout for fetching a single feed.").Default("30s").Duration()
+	serveMaxFailures = serve.Flag("max-failures", "Disable feeds after this many consecutive failures, 0 to never disable.").Default("10").Int()
+	servePrefetch    = serve.Flag("prefetch-workers", "Number of articles prefetched concurrently for feeds with prefetching enabled, 0 to disable.").Default("2").Int()
+	servePrefetchGap = serve.Flag("prefetch-delay", "Minimum time between two prefetches from the same host.").Default("5s").Duration()
+	serveAdminToken  = serve.Flag("admin-token", "Token to log into the control center with, in addition to admin accounts.").Envar("GONEWS_ADMIN_TOKEN").Default("").String()
 
 	add            = app.Command("add", "Add something.")
 	addFeed        = add.Command("feed", "Add a feed.")
 	addFeedHandle  = addFeed.Arg("handle", "Handle the feed should be identified by.").Required().String()
 	addFeedAddress = addFeed.Arg("address", "Address of the RSS feed to add.").Required().String()
-	addRequest     = add.Command("request", "Add a feed request (not implemented)")
+	addRequest     = add.Command("request", "Add a feed request.")
+	addRequestURL  = addRequest.Arg("address", "Address of the requested RSS feed.").Required().String()
 	addDefFeeds    = add.Command("deffeeds", "Add default feeds.")
+	addAccount     = add.Command("account", "Add an account or change its password, which is read from standard input.")
+	addAccountName = addAccount.Arg("name", "Name of the account.").Required().String()
+	addAccountAdm  = addAccount.Flag("admin", "Allow the account into the control center.").Bool()
 
 	del                    = app.Command("delete", "Delete something.")
-	delFeed                = del.Command("feed", "Delete a feed.")
+	delFeed                = del.Command("feed", "Delete a feed and all of its posts.")
 	delFeedHandleOrAddress = delFeed.Arg("handle-or-address", "Handle or address of the feed to delete").Required().String()
 
 	clear        = app.Command("clear", "Clear something.")
-	clearRequest = clear.Command("requests", "Clear all feed requests.")
+	clearRequest = clear.Command("requests", "Clear all feed requests except bans.")
 
 	list      = app.Command("list", "List something.")
 	listFeeds = list.Command("feeds", "List all feeds.")
+	listReqs  = list.Command("requests", "List pending feed requests.")
+	listAll   = listReqs.Flag("all", "Include decided requests.").Bool()
+
+	approve           = app.Command("approve", "Approve something.")
+	approveRequestCmd = approve.Command("request", "Fetch a requested feed and add it.")
+	approveRequestURL = approveRequestCmd.Arg("address", "Address of the requested RSS feed.").Required().String()
+	approveHandle     = approveRequestCmd.Arg("handle", "Handle the feed should be identified by.").Required().String()
+
+	reject           = app.Command("reject", "Reject something.")
+	rejectRequestCmd = reject.Command("request", "Reject a feed request, it may be requested again.")
+	rejectRequestURL = rejectRequestCmd.Arg("address", "Address of the requested RSS feed.").Required().String()
+
+	ban           = app.Command("ban", "Ban something.")
+	banRequestCmd = ban.Command("request", "Reject a feed request for good.")
+	banRequestURL = banRequestCmd.Arg("address", "Address of the RSS feed to ban.").Required().String()
+
+	search      = app.Command("search", "Search posts.")
+	searchQuery = search.Arg("query", "Words, \"phrases\", feed:<handle>, after:<YYYY-MM-DD> and before:<YYYY-MM-DD>.").Required().String()
+	searchLimit = search.Flag("limit", "Maximum number of results.").Short('n').Default("25").Int()
+
+	importCmd        = app.Command("import", "Import something.")
+	importOPML       = importCmd.Command("opml", "Import feeds from an OPML file.")
+	importOPMLFile   = importOPML.Arg("file", "OPML file to import.").Required().String()
+	importOPMLDryRun = importOPML.Flag("dry-run", "Only report what would be imported.").Bool()
+
+	exportCmd      = app.Command("export", "Export something.")
+	exportOPML     = exportCmd.Command("opml", "Export all feeds as OPML.")
+	exportOPMLFile = exportOPML.Arg("file", "File to write, standard output if omitted.").String()
 
 	initialize        = app.Command("init", "Initialize the database.")
 	initializeEmpty   = initialize.Command("empty", "Initialize the database as empty.")
 	initializeDefault = initialize.Command("defaults", "Initialize the database with defaults.")
-	initializeNew     = initialize.Command("new", "Initialize experimental sql database.")
 
-	migrate = app.Command("migrate", "Migrate database from old format.")
+	migrate          = app.Command("migrate", "Migrate databases.")
+	migrateBolt      = migrate.Command("bolt", "Update a bolt database from an old format, the default.").Default()
+	migrateSQL       = migrate.Command("sql", "Update the schema of the sql database.")
+	migrateBoltToSQL = migrate.Command("bolt-to-sql", "Copy a bolt database into the sql database.")
+	migrateBoltPath  = migrateBoltToSQL.Flag("db-path", "Path to the bolt database file.").Short('d').Default("./data.bolt").String()
 
 	// embedded services
-	store *Store = nil
-	feedd *FeedD = nil
-	stats *Stats = nil
+	store      Storage     = nil
+	articles   *Articles   = nil
+	feedd      *FeedD      = nil
+	stats      *Stats      = nil
+	sessions   *Sessions   = nil
+	prefetcher *Prefetcher = nil
 
 	// regexps
-	handleRE = regexp.MustCompile("[a-zA-Z][a-zA-Z0-9]*")
+	handleRE = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9]*$")
 )
 
 func loadHTMLGlob(engine *gin.Engine, pattern string, urlfunc func(string) string) {
@@ -79,6 +126,9 @@ func loadHTMLGlob(engine *gin.Engine, pattern string, urlfunc func(string) strin
 		"when": func(t time.Time) string {
 			return DurationToHuman(t.UTC().Sub(time.Now().UTC()))
 		},
+		"duration": func(d time.Duration) string {
+			return d.Round(time.Millisecond).String()
+		},
 		"lastPost": func(posts []*Post) *Post {
 			if len(posts) > 0 {
 				return posts[len(posts)-1]
@@ -91,28 +141,68 @@ func loadHTMLGlob(engine *gin.Engine, pattern string, urlfunc func(string) strin
 	engine.SetHTMLTemplate(templ)
 }
 
+// feedsByID indexes feeds by their id for the templates.
+func feedsByID(feeds []*Feed) map[int64]*Feed {
+	res := make(map[int64]*Feed)
+	for _, feed := range feeds {
+		res[feed.ID] = feed
+	}
+	return res
+}
+
+// selectFeeds returns the ids of the feeds whose handles are in selection,
+// separated by "+". An empty selection selects all feeds and returns nil.
+func selectFeeds(feeds []*Feed, selection string) []int64 {
+	if selection == "" {
+		return nil
+	}
+	feedsLookup := make(map[string]bool)
+	for _, feed := range strings.Split(selection, "+") {
+		feedsLookup[feed] = true
+	}
+	selected := make([]int64, 0)
+	for _, feed := range feeds {
+		if feedsLookup[feed.Handle] {
+			selected = append(selected, feed.ID)
+		}
+	}
+	return selected
+}
+
 func cmdRun() error {
+	var err error
+
 	// START STORAGE SERVICE
 
-	store, err := NewStore(*appDbPath, NewPrefixedLogger("store"))
+	store, err = OpenStorage(*appDbUri)
 	if err != nil {
 		return err
 	}
-	defer store.Close()
+	defer store.Disconnect()
+
+	articles = NewArticles(store, NewPrefixedLogger("articles"))
+
+	// START ARTICLE PREFETCHER
 
-	if store.CheckVersion() != "0.2" {
-		return errors.New("old database format")
+	if *servePrefetch > 0 {
+		prefetcher = NewPrefetcher(articles, *servePrefetch, *servePrefetchGap, NewPrefixedLogger("prefetch"))
+		if err := prefetcher.Start(); err != nil {
+			return err
+		}
+		defer prefetcher.Stop()
 	}
 
 	// START FEED CRAWLER
 
-	feedd := NewFeedD(store, NewPrefixedLogger("feedd"))
-	feedd.Start()
+	feedd = NewFeedD(store, *serveWorkers, *serveTimeout, *serveMaxFailures, NewPrefixedLogger("feedd"))
+	if err := feedd.Start(); err != nil {
+		return err
+	}
 	defer feedd.Stop()
 
 	// START STATISTICS COLLECTION
 
-	stats := NewStats(NewPrefixedLogger("stats"))
+	stats = NewStats(NewPrefixedLogger("stats"))
 	stats.Start()
 	defer stats.Stop()
 
@@ -121,7 +211,12 @@ func cmdRun() error {
 	stoptrim := make(chan bool, 1)
 	go func(stop chan bool) {
 		for true {
-			store.PostsTrim()
+			n, err := trimPosts()
+			if err != nil {
+				logger.Printf("ERROR: trimming posts: %s", err.Error())
+			} else {
+				logger.Printf("trimmed %d posts", n)
+			}
 			select {
 			case <-stop:
 				return
@@ -134,6 +229,8 @@ func cmdRun() error {
 		stoptrim <- true
 	}()
 
+	sessions = NewSessions()
+
 	// CONFIGURE SERVER
 
 	url := func(url string) string {
@@ -150,6 +247,13 @@ func cmdRun() error {
 
 	loadHTMLGlob(r, "./templates/*", url)
 
+	r.Use(func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, url("/static")) {
+			stats.AddVisit(c.ClientIP())
+		}
+		c.Next()
+	})
+
 	// CONFIGURE ROUTES
 
 	r.Static(url("/static"), "./static")
@@ -174,95 +278,291 @@ func cmdRun() error {
 		sitemap := make(map[string]string)
 		sitemap["/f/"] = "show all feeds"
 		sitemap["/f/bbc+wik"] = "show only feeds BBC and Wiki News"
+		sitemap["/f/?unread=1"] = "show only unread news"
+		sitemap["/f/bbc+wik.atom"] = "BBC and Wiki News as atom feed, .rss for rss"
 		sitemap["/l/"] = "list available feeds"
+		sitemap["/l/feeds.opml"] = "all feeds as OPML"
+		sitemap["/u/"] = "log in and choose your feeds"
+		sitemap["/saved/"] = "your saved news"
+		sitemap["/c/"] = "control center"
 		sitemap["/r/"] = "request a feed to be added"
+		sitemap["/s/"] = "search news"
+		sitemap["/api/v1/posts"] = "news as json"
 		//sitemap["/i/"] = "statistics"
 		c.HTML(200, "index.tmpl", gin.H{"sitemap": sitemap})
 	})
 
 	/*   /f/ - NEWS */
 
-	r.GET(url("/f/"), func(c *gin.Context) {
+	// postsPage renders a page of posts of the selected feeds, read posts are
+	// marked or left out with ?unread=1
+	postsPage := func(c *gin.Context, feeds []*Feed, selected []int64, data gin.H) {
 		after := c.Query("after")
-		path := c.Request.URL.Path
-		feedsMap := store.FeedsAllMap()
 		var refID int64
 		if after == "" {
 			refID = MakeIDRaw(time.Now(), 0, 0)
 		} else {
 			refID = UnhashID(after)
 		}
-		posts := store.PostsFilter(*servePerPage, func(p *Post) bool {
-			return p.ID < refID
-		})
-		c.HTML(200, "posts.tmpl",
-			gin.H{"posts": posts, "feeds": feedsMap, "path": path})
+		state, err := readState(c)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		unread := c.Query("unread") != ""
+		var posts []*Post
+		if unread {
+			posts, err = unreadPage(*servePerPage, refID, selected, state)
+		} else {
+			posts, err = store.PostPage(*servePerPage, refID, selected)
+		}
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		data["posts"] = posts
+		data["feeds"] = feedsByID(feeds)
+		data["path"] = c.Request.URL.Path
+		data["read"] = readPosts(posts, state)
+		data["unread"] = unread
+		csrf, err := formCSRF(c)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		data["until"] = HashID(MakeIDRaw(time.Now(), 0, 0))
+		data["session"] = currentSession(c)
+		data["csrf"] = csrf
+		c.HTML(200, "posts.tmpl", data)
+	}
+
+	// markRead marks all posts of the selected feeds up to the time the page
+	// was rendered as read
+	markRead := func(c *gin.Context, selected []int64) {
+		if !validFormCSRF(c) {
+			c.String(http.StatusForbidden, "invalid form token, reload the page")
+			return
+		}
+		if selected == nil {
+			feeds, err := store.FeedAll()
+			if err != nil {
+				c.String(200, "Internal error")
+				return
+			}
+			selected = make([]int64, 0, len(feeds))
+			for _, feed := range feeds {
+				selected = append(selected, feed.ID)
+			}
+		}
+		until := UnhashID(c.PostForm("until"))
+		if now := MakeIDRaw(time.Now(), 0, 0); until <= 0 || until > now {
+			until = now
+		}
+		reader, err := readerID(c, true)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		if err = store.ReadStateMarkAll(reader, selected, until); err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, c.Request.URL.RequestURI())
+	}
+
+	// homeFeeds selects the feeds shown at /f/: the subscriptions of logged
+	// in users unless they ask for all feeds
+	homeFeeds := func(c *gin.Context) ([]int64, bool, error) {
+		all := c.Query("all") != ""
+		if all {
+			return nil, all, nil
+		}
+		selected, err := subscribedFeeds(c)
+		return selected, all, err
+	}
+
+	r.GET(url("/f/"), func(c *gin.Context) {
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		selected, all, err := homeFeeds(c)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		postsPage(c, feeds, selected, gin.H{"all": all, "subscribed": selected != nil})
+	})
+	r.POST(url("/f/"), func(c *gin.Context) {
+		selected, _, err := homeFeeds(c)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		markRead(c, selected)
 	})
 	r.GET(url("/f/:feeds"), func(c *gin.Context) {
 		after := c.Query("after")
 		path := c.Request.URL.Path
-		feedsMap := store.FeedsAllMap()
+		// a trailing .atom or .rss asks for a feed document, /f/.atom for
+		// all feeds
+		selection, format := syndicationFormat(c.Param("feeds"))
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		selected := selectFeeds(feeds, selection)
+		if format == "" {
+			postsPage(c, feeds, selected, gin.H{"selection": true})
+			return
+		}
 		var refID int64
 		if after == "" {
 			refID = MakeIDRaw(time.Now(), 0, 0)
 		} else {
 			refID = UnhashID(after)
 		}
-		feedsLookup := make(map[string]bool)
-		for _, feed := range strings.Split(c.Param("feeds"), "+") {
-			feedsLookup[feed] = true
+		posts, err := store.PostPage(*servePerPage, refID, selected)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
 		}
-		posts := store.PostsFilter(*servePerPage, func(p *Post) bool {
-			feed := feedsMap[p.Feed].Handle
-			_, ok := feedsLookup[feed]
-			return p.ID < refID && ok
-		})
-		c.HTML(200, "posts.tmpl",
-			gin.H{"posts": posts, "feeds": feedsMap, "path": path})
+		title := "news : latest"
+		if selection != "" {
+			title = "news : " + selection
+		}
+		writeSyndication(c, format, title, path, url("/f/"+selection), posts, feedsByID(feeds))
+	})
+	r.POST(url("/f/:feeds"), func(c *gin.Context) {
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		markRead(c, selectFeeds(feeds, c.Param("feeds")))
+	})
+
+	/*   /s/ - SEARCH */
+
+	r.GET(url("/s/"), func(c *gin.Context) {
+		after := c.Query("after")
+		query := c.Query("q")
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		q, err := db.ParseQuery(query)
+		if err != nil {
+			c.HTML(200, "search.tmpl", gin.H{"query": query, "error": err.Error()})
+			return
+		}
+		if q.Empty() {
+			c.HTML(200, "search.tmpl", gin.H{"query": query})
+			return
+		}
+		var refID int64
+		if after == "" {
+			refID = MakeIDRaw(time.Now(), 0, 0)
+		} else {
+			refID = UnhashID(after)
+		}
+		posts, err := store.PostSearch(q, *servePerPage, refID)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		c.HTML(200, "search.tmpl",
+			gin.H{"query": query, "posts": posts, "feeds": feedsByID(feeds)})
 	})
 
 	/*   /l/ - FEED LIST */
 
 	r.GET(url("/l/"), func(c *gin.Context) {
-		feeds := store.FeedsAll()
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
 		c.HTML(200, "feeds.tmpl", gin.H{"feeds": feeds})
 	})
 
+	r.GET(url("/l/feeds.opml"), func(c *gin.Context) {
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		var buf bytes.Buffer
+		if err := WriteOPML(&buf, feeds); err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="feeds.opml"`)
+		c.Data(200, "text/x-opml; charset=utf-8", buf.Bytes())
+	})
+
 	/*   /a/*- ARTICLES */
 
 	r.GET(url("/a/:articleid"), func(c *gin.Context) {
 		postID := UnhashID(c.Param("articleid"))
-		if err != nil {
+		post, err := store.PostGet(postID)
+		if err == db.ErrNotFound {
+			c.String(200, fmt.Sprintf("invalid article: %s", HashID(postID)))
+			return
+		} else if err != nil {
 			c.String(200, "Internal error")
 			return
 		}
-		post := store.PostsGet(postID)
-		if post == nil {
-			c.String(200, fmt.Sprintf("invalid article: %s", HashID(postID)))
+		// feed is nil if it was removed in the meantime
+		feed, err := store.FeedGet(post.Feed)
+		if err != nil && err != db.ErrNotFound {
+			c.String(200, "Internal error")
 			return
 		}
-		feedsMap := store.FeedsAllMap()
-		feed := feedsMap[post.Feed]
-		r, err := store.ReadabilityGetOne(post.ID)
+		r, err := articles.Get(post)
 		if err != nil {
 			c.String(200, err.Error())
 			return
 		}
-		c.HTML(200, "article.tmpl",
-			gin.H{"post": post, "content": template.HTML(r.Content), "feed": feed})
+		stats.AddRead(1)
+		if reader, err := readerID(c, true); err != nil {
+			logger.Printf("unable to identify reader: %s", err.Error())
+		} else if err = store.ReadStateMark(reader, post); err != nil {
+			logger.Printf("unable to mark %s read: %s", HashID(post.ID), err.Error())
+		}
+		saved, err := isSaved(c, post)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		c.HTML(200, "article.tmpl", gin.H{"post": post, "content": template.HTML(r.Content), "feed": feed,
+			"meta": r.Meta, "session": currentSession(c), "saved": saved})
 	})
 
 	/*   /r/ - FEED REQUESTS */
 
 	r.GET(url("/r/"), func(c *gin.Context) {
-		requests, err := store.FeedReqsAll()
+		requests, err := store.RequestAll()
 		if err != nil {
 			c.String(200, "Internal error")
 			return
 		}
-		_ = sort.IsSorted(FeedReqsByCount(requests))
-		sort.Reverse(FeedReqsByCount(requests))
-		c.HTML(200, "requests.tmpl", gin.H{"requests": requests})
+		pending := make([]*FeedReq, 0)
+		decided := make([]*FeedReq, 0)
+		for _, req := range requests {
+			if req.Pending() {
+				pending = append(pending, req)
+			} else if req.Status != db.RequestBanned {
+				decided = append(decided, req)
+			}
+		}
+		sort.SliceStable(decided, func(i, j int) bool {
+			return decided[i].DecidedAt.After(decided[j].DecidedAt)
+		})
+		c.HTML(200, "requests.tmpl", gin.H{"requests": pending, "decided": decided})
 	})
 	r.POST(url("/r/"), func(c *gin.Context) {
 		reqURL := strings.Trim(c.PostForm("feedurl"), " \t\n\r\f")
@@ -270,78 +570,104 @@ func cmdRun() error {
 			c.String(200, "malformed feed request url")
 			return
 		}
-		store.FeedReqsAdd(reqURL)
+		feeds, err := store.FeedAll()
 		if err != nil {
 			c.String(200, "Internal error")
 			return
 		}
+		for _, feed := range feeds {
+			if feed.URL == reqURL {
+				c.Redirect(303, url("/f/"+feed.Handle))
+				return
+			}
+		}
+		err = store.RequestAdd(MakeID(), reqURL)
+		if err == db.ErrBanned || err == db.ErrRequestLimit {
+			c.String(200, err.Error())
+			return
+		} else if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
 		c.Redirect(303, url("/r/"))
 	})
 
+	/*   /u/*- USER PAGES */
+
+	registerUser(r, url)
+
+	/*   /saved/*- SAVED POSTS */
+
+	registerSaved(r, url)
+
 	/*   /c/*- CONTROL CENTER */
 
-	/*
-	   r.GET(url("/c/"), func(c *gin.Context) {
-	       userpw := c.Query("passwd")
-	       if subtle.ConstantTimeCompare([]byte(userpw), []byte(app.Passwd)) == 0 {
-	           c.String(200, "access denied")
-	           return
-	       }
-	       stats := make(map[string]interface{})
-	       stats["numFeeds"] = len(store.FeedsAll())
-	       stats["numPosts"] = len(store.PostsFilter(-1, func (*Post) bool { return true; }))
-	       c.HTML(200, "control.tmpl", gin.H{"stats": stats})
-	   });
-
-	   r.POST(url("/c/"), func(c *gin.Context) {
-	       userpw := c.Query("passwd")
-	       if subtle.ConstantTimeCompare([]byte(userpw), []byte(app.Passwd)) == 0 {
-	           c.String(200, "access denied")
-	           return
-	       }
-	       key := c.PostForm("cmd")
-	       val := c.PostForm("arg")
-	       c.String(200, key + " = " + val)
-	   })
-	*/
+	registerControl(r, url)
 
 	/*   /x/*- APIs */
 
 	r.GET(url("/x/r/:articleid"), func(c *gin.Context) {
 		postID := UnhashID(c.Param("articleid"))
-		if err != nil {
-			c.String(200, err.Error())
+		post, err := store.PostGet(postID)
+		if err == db.ErrNotFound {
+			c.String(404, fmt.Sprintf("invalid article: %d", postID))
 			return
-		}
-		post := store.PostsGet(postID)
-		if post == nil {
-			c.String(200, fmt.Sprintf("invalid article: %d", postID))
+		} else if err != nil {
+			c.String(500, "Internal error")
 			return
 		}
-		r, err := store.ReadabilityGetOne(post.ID)
+		r, err := articles.Get(post)
 		if err != nil {
-			c.String(200, err.Error())
+			c.String(502, err.Error())
 			return
 		}
 		js, err := json.Marshal(r)
 		if err != nil {
-			c.String(200, err.Error())
+			c.String(500, err.Error())
 			return
 		}
-		c.String(200, string(js))
+		c.Data(200, "application/json; charset=utf-8", js)
 	})
 
-	r.Run(*serveBindAddress)
+	/*   /api/v1/* - JSON API */
 
-	return nil
+	registerAPI(r.Group(url("/api/v1")))
+
+	// RUN UNTIL INTERRUPTED
+
+	server := &http.Server{Addr: *serveBindAddress, Handler: r}
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-signals:
+		logger.Printf("received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
 
 func cmdUpdateDb() error {
-	store, err := NewStore(*appDbPath, NewPrefixedLogger("store"))
+	scheme, path, err := splitStorageURI(*appDbUri)
+	if err != nil {
+		return err
+	}
+	if scheme != "bolt" {
+		return errors.New("only bolt databases need to be migrated")
+	}
+	store, err := NewStore(path, NewPrefixedLogger("store"))
 	if err != nil {
 		return err
 	}
-	defer store.Close()
+	defer store.Disconnect()
 
 	return store.UpdateDB()
 }
@@ -351,15 +677,16 @@ func cmdAddFeed(handle string, address string) error {
 		return errors.New("invalid handle")
 	}
 	var (
-		conn *db.DB
-		err error
+		conn Storage
+		err  error
 	)
-	if conn, err = db.Connect(*appDbUri); err != nil {
+	if conn, err = OpenStorage(*appDbUri); err != nil {
 		return err
 	}
 	defer conn.Disconnect()
 
 	var feed db.Feed
+	feed.ID = MakeID()
 	feed.Handle = handle
 	feed.URL = address
 	_, err = conn.FeedAdd(&feed)
@@ -368,10 +695,10 @@ func cmdAddFeed(handle string, address string) error {
 
 func cmdAddDefaultFeeds() error {
 	var (
-		conn *db.DB
-		err error
+		conn Storage
+		err  error
 	)
-	if conn, err = db.Connect(*appDbUri); err != nil {
+	if conn, err = OpenStorage(*appDbUri); err != nil {
 		return err
 	}
 	defer conn.Disconnect()
@@ -389,6 +716,7 @@ func cmdAddDefaultFeeds() error {
 	var feed db.Feed
 	nerr := 0
 	for _, feedIn := range feeds {
+		feed.ID = MakeID()
 		feed.Handle = feedIn.Handle
 		feed.URL = feedIn.URL
 		_, err = conn.FeedAdd(&feed)
@@ -404,15 +732,29 @@ func cmdAddDefaultFeeds() error {
 }
 
 func cmdDeleteFeed(handleOrAddress string) error {
-	return errors.New("not implemented")
+	var (
+		conn Storage
+		err  error
+	)
+	if conn, err = OpenStorage(*appDbUri); err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	n, err := conn.FeedRemoveByHandleOrURL(handleOrAddress)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted feed %s and %d posts\n", handleOrAddress, n)
+	return nil
 }
 
 func cmdListFeeds() error {
 	var (
-		conn *db.DB
-		err error
+		conn Storage
+		err  error
 	)
-	if conn, err = db.Connect(*appDbUri); err != nil {
+	if conn, err = OpenStorage(*appDbUri); err != nil {
 		return err
 	}
 	defer conn.Disconnect()
@@ -425,6 +767,50 @@ func cmdListFeeds() error {
 		fmt.Printf("%d\n", i)
 		fmt.Printf("  %s | %s\n", feed.Handle, feed.Title)
 		fmt.Printf("  %s\n", feed.URL)
+		switch {
+		case feed.Disabled:
+			fmt.Printf("  disabled after %d failures (status %d): %s\n", feed.Failures, feed.Status, feed.LastError)
+		case feed.Failures > 0:
+			fmt.Printf("  failing %d times (status %d): %s\n", feed.Failures, feed.Status, feed.LastError)
+		case feed.LastSuccess.IsZero():
+			fmt.Printf("  not fetched yet\n")
+		default:
+			fmt.Printf("  ok, last fetched %s\n", feed.LastSuccess.Format("2006-01-02 15:04 -0700"))
+		}
+	}
+	return nil
+}
+
+func cmdSearch(query string, limit int) error {
+	q, err := db.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	if q.Empty() {
+		return errors.New("empty query")
+	}
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	feeds, err := conn.FeedAll()
+	if err != nil {
+		return err
+	}
+	feedMap := feedsByID(feeds)
+	posts, err := conn.PostSearch(q, limit, MakeIDRaw(time.Now(), 0, 0))
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		handle := "?"
+		if feed, ok := feedMap[post.Feed]; ok {
+			handle = feed.Handle
+		}
+		fmt.Printf("%s  %-8s %s\n", post.Date.Format("2006-01-02 15:04"), handle, post.Title)
+		fmt.Printf("  %s\n", post.Link)
 	}
 	return nil
 }
@@ -441,24 +827,42 @@ func main() {
 		funclet = cmdRun
 	case "add feed":
 		funclet = func() error { return cmdAddFeed(*addFeedHandle, *addFeedAddress) }
+	case "add account":
+		funclet = func() error { return cmdAddAccount(*addAccountName, *addAccountAdm) }
 	case "add deffeeds":
 		funclet = func() error { return cmdAddDefaultFeeds() }
 	case "add request":
-		funclet = func() error { return errors.New("not implemented") }
+		funclet = func() error { return cmdAddRequest(*addRequestURL) }
 	case "delete feed":
 		funclet = func() error { return cmdDeleteFeed(*delFeedHandleOrAddress) }
 	case "clear requests":
-		funclet = func() error { return errors.New("not implemented") }
+		funclet = func() error { return cmdClearRequests() }
 	case "list feeds":
 		funclet = func() error { return cmdListFeeds() }
+	case "list requests":
+		funclet = func() error { return cmdListRequests(*listAll) }
+	case "approve request":
+		funclet = func() error { return cmdApproveRequest(*approveRequestURL, *approveHandle) }
+	case "reject request":
+		funclet = func() error { return cmdDecideRequest(*rejectRequestURL, db.RequestRejected) }
+	case "ban request":
+		funclet = func() error { return cmdDecideRequest(*banRequestURL, db.RequestBanned) }
+	case "search":
+		funclet = func() error { return cmdSearch(*searchQuery, *searchLimit) }
+	case "import opml":
+		funclet = func() error { return cmdImportOPML(*importOPMLFile, *importOPMLDryRun) }
+	case "export opml":
+		funclet = func() error { return cmdExportOPML(*exportOPMLFile) }
 	case "init defaults":
-		funclet = func() error { return cmdInitDefaults(*appDbPath) }
+		funclet = func() error { return cmdInitDefaults(*appDbUri) }
 	case "init empty":
-		funclet = func() error { return cmdInit(*appDbPath) }
-	case "init new":
-		funclet = func() error { _, err := db.Connect(*appDbUri); return err }
-	case "migrate":
+		funclet = func() error { return cmdInit(*appDbUri) }
+	case "migrate bolt":
 		funclet = cmdUpdateDb
+	case "migrate sql":
+		funclet = func() error { return cmdMigrateSQL(*appDbUri) }
+	case "migrate bolt-to-sql":
+		funclet = func() error { return cmdMigrateBoltToSQL(*migrateBoltPath, *appDbUri) }
 	default:
 		kingpin.Usage()
 	}
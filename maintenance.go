@@ -2,34 +2,48 @@ package main
 
 import (
 	_ "bytes"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+
+	"github.com/alexander-matz/go-news/db"
 )
 
-func cmdInit(dbFile string) error {
-	var err error
-	store, err := NewStore(dbFile, log.New(os.Stderr, "LOG|", 0))
+func cmdInit(uri string) error {
+	scheme, path, err := splitStorageURI(uri)
+	if err != nil {
+		return err
+	}
+	if scheme != "bolt" {
+		return cmdMigrateSQL(uri)
+	}
+	store, err := NewStore(path, log.New(os.Stderr, "LOG|", 0))
 	if err != nil {
 		return err
 	}
-	defer store.Close()
+	defer store.Disconnect()
 	store.Init()
 	return nil
 }
 
-func cmdInitDefaults(dbFile string) error {
-	var err error
-
-	os.Remove(dbFile)
-	store, err := NewStore(dbFile, NewPrefixedLogger("store"))
+func cmdInitDefaults(uri string) error {
+	scheme, path, err := splitStorageURI(uri)
 	if err != nil {
 		return err
 	}
-	defer store.Close()
-	err = store.Init()
+	if scheme == "bolt" {
+		os.Remove(path)
+	}
+	if err = cmdInit(uri); err != nil {
+		return err
+	}
+	store, err := OpenStorage(uri)
 	if err != nil {
 		return err
 	}
+	defer store.Disconnect()
 
 	var feed Feed
 
@@ -37,51 +51,325 @@ func cmdInitDefaults(dbFile string) error {
 	feed.ID = MakeID()
 	feed.URL = "http://feeds.bbci.co.uk/news/rss.xml"
 	feed.Handle = "bbc"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
 		return err
 	}
 
 	feed.ID = MakeID()
 	feed.URL = "http://feeds.bbci.co.uk/news/world/europe/rss.xml"
 	feed.Handle = "bbce"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
 		return err
 	}
 
 	feed.ID = MakeID()
 	feed.URL = "https://en.wikinews.org/w/index.php?title=Special:NewsFeed&feed=atom&categories=Published&notcategories=No%20publish%7CArchived%7CAutoArchived%7Cdisputed&namespace=0&count=30&hourcount=124&ordermethod=categoryadd&stablepages=only"
 	feed.Handle = "wik"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
 		return err
 	}
 
 	feed.ID = MakeID()
 	feed.URL = "http://rss.csmonitor.com/feeds/csm"
 	feed.Handle = "csm"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
 		return err
 	}
 
 	feed.ID = MakeID()
 	feed.URL = "http://www.aljazeera.com/xml/rss/all.xml"
 	feed.Handle = "alj"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
 		return err
 	}
 
 	feed.ID = MakeID()
 	feed.URL = "http://www.economist.com/sections/culture/rss.xml"
 	feed.Handle = "ecoc"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
 		return err
 	}
 
 	feed.ID = MakeID()
 	feed.URL = "http://www.economist.com/sections/international/rss.xml"
 	feed.Handle = "ecoi"
-	if err = store.FeedsSet(&feed); err != nil {
+	if _, err = store.FeedAdd(&feed); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// cmdMigrateSQL brings the schema of the sql database at uri up to date, or
+// creates it if the database is empty.
+func cmdMigrateSQL(uri string) error {
+	conn, err := db.Open(uri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	from, err := conn.Migrate()
+	if err != nil {
+		return err
+	}
+	if from == db.SchemaVersion() {
+		logger.Printf("schema on newest version %d", from)
+	} else {
+		logger.Printf("schema migrated from version %d to %d", from, db.SchemaVersion())
+	}
+	return nil
+}
+
+// migrateCursor is the setting remembering the last post copied from bolt, so
+// an interrupted migration continues where it stopped.
+const migrateCursor = "migrate.bolt.posts"
+
+// cmdMigrateBoltToSQL copies feeds, posts with their content, feed requests,
+// accounts with their subscriptions and saved posts, and the read state from
+// the bolt database at path into the sql database at uri, keeping all ids.
+// Whatever already exists in the sql database is left alone, so the
+// migration can simply be run again if it was interrupted.
+func cmdMigrateBoltToSQL(path string, uri string) error {
+	scheme, _, err := splitStorageURI(uri)
+	if err != nil {
+		return err
+	}
+	if scheme == "bolt" {
+		return errors.New("migration target must be a sql database")
+	}
+
+	src, err := NewStore(path, NewPrefixedLogger("store"))
+	if err != nil {
 		return err
 	}
+	defer src.Disconnect()
+	if version := src.CheckVersion(); version != storeVersion {
+		return fmt.Errorf("bolt database has version %s, run migrate bolt first", version)
+	}
 
+	if err = cmdMigrateSQL(uri); err != nil {
+		return err
+	}
+	dst, err := db.Connect(uri)
+	if err != nil {
+		return err
+	}
+	defer dst.Disconnect()
+
+	// feeds
+	feeds, err := src.FeedAll()
+	if err != nil {
+		return err
+	}
+	copied := 0
+	for _, feed := range feeds {
+		if _, err := dst.FeedGet(feed.ID); err == nil {
+			continue
+		} else if err != db.ErrNotFound {
+			return err
+		}
+		if _, err := dst.FeedAdd(feed); err != nil {
+			return fmt.Errorf("feed %s: %s", feed.Handle, err.Error())
+		}
+		copied += 1
+	}
+	logger.Printf("feeds: %d copied, %d already present", copied, len(feeds)-copied)
+
+	// posts, in batches and oldest first so the cursor only moves forward
+	var after int64 = 0
+	if cursor, err := dst.SettingGet(migrateCursor); err == nil {
+		after, _ = strconv.ParseInt(cursor, 10, 64)
+		logger.Printf("resuming after post %s", HashID(after))
+	} else if err != db.ErrNotFound {
+		return err
+	}
+	copied, skipped, contents := 0, 0, 0
+	err = src.PostsEach(after, 500, func(posts []*Post) error {
+		inserted, err := dst.PostAddBatch(posts)
+		if err != nil {
+			return err
+		}
+		// an interrupted run may have left posts without their content, so
+		// every post is checked, not only the inserted ones
+		for _, post := range posts {
+			if post.Content == "" {
+				continue
+			}
+			present := Post{ID: post.ID}
+			if err := dst.PostFetchContent(&present); err == nil {
+				continue
+			} else if err != db.ErrNoContent {
+				return err
+			}
+			if err := dst.PostStoreContent(post); err != nil {
+				return err
+			}
+			contents += 1
+		}
+		copied += len(inserted)
+		skipped += len(posts) - len(inserted)
+		if len(posts) == 0 {
+			return nil
+		}
+		last := strconv.FormatInt(posts[len(posts)-1].ID, 10)
+		return dst.SettingSet(migrateCursor, last)
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("posts: %d copied, %d already present, %d contents copied", copied, skipped, contents)
+
+	// feed requests
+	reqs, err := src.RequestAll()
+	if err != nil {
+		return err
+	}
+	present, err := dst.RequestAll()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, req := range present {
+		known[req.URL] = true
+	}
+	copied = 0
+	for _, req := range reqs {
+		if known[req.URL] {
+			continue
+		}
+		if err := dst.RequestImport(req); err != nil {
+			return fmt.Errorf("request %s: %s", req.URL, err.Error())
+		}
+		copied += 1
+	}
+	logger.Printf("requests: %d copied, %d already present", copied, len(reqs)-copied)
+
+	// accounts
+	accounts, err := src.AccountAll()
+	if err != nil {
+		return err
+	}
+	copied = 0
+	for _, account := range accounts {
+		if _, err := dst.AccountGet(account.Name); err == db.ErrNotFound {
+			if err := dst.AccountAdd(account); err != nil {
+				return fmt.Errorf("account %s: %s", account.Name, err.Error())
+			}
+			copied += 1
+		} else if err != nil {
+			return err
+		}
+		// a previous run may have stopped after adding the account, its
+		// subscriptions are only left alone if there are any
+		present, err := dst.SubscriptionAll(account.ID)
+		if err != nil {
+			return err
+		}
+		subscriptions, err := src.SubscriptionAll(account.ID)
+		if err != nil {
+			return err
+		}
+		if len(present) == 0 && len(subscriptions) > 0 {
+			if err := dst.SubscriptionSet(account.ID, subscriptions); err != nil {
+				return fmt.Errorf("subscriptions of %s: %s", account.Name, err.Error())
+			}
+		}
+		saved, err := src.SavedAll(account.ID)
+		if err != nil {
+			return err
+		}
+		for _, post := range saved {
+			if err := dst.SavedAdd(account.ID, post.ID); err != nil {
+				return fmt.Errorf("saved posts of %s: %s", account.Name, err.Error())
+			}
+		}
+	}
+	logger.Printf("accounts: %d copied, %d already present", copied, len(accounts)-copied)
+
+	// read state of accounts and anonymous readers, marks only move forward
+	// and read posts are only added, so copying it again does no harm
+	readers := 0
+	err = src.ReadStateEach(func(reader int64, marks map[int64]int64, read []*Post) error {
+		for feed, mark := range marks {
+			if err := dst.ReadStateMarkAll(reader, []int64{feed}, mark); err != nil {
+				return err
+			}
+		}
+		for _, post := range read {
+			if err := dst.ReadStateMark(reader, post); err != nil {
+				return err
+			}
+		}
+		readers += 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("read state: %d readers copied", readers)
+
+	return verifyBoltToSQL(src, dst)
+}
+
+// verifyBoltToSQL checks that everything in the bolt database made it into
+// the sql database.
+func verifyBoltToSQL(src *Store, dst *db.DB) error {
+	missing := 0
+
+	feeds, err := src.FeedAll()
+	if err != nil {
+		return err
+	}
+	for _, feed := range feeds {
+		got, err := dst.FeedGet(feed.ID)
+		if err == db.ErrNotFound || (err == nil && (got.Handle != feed.Handle || got.URL != feed.URL)) {
+			logger.Printf("WARNING: feed %s missing", feed.Handle)
+			missing += 1
+		} else if err != nil {
+			return err
+		}
+	}
+
+	posts := 0
+	err = src.PostsEach(0, 500, func(batch []*Post) error {
+		for _, post := range batch {
+			posts += 1
+			if _, err := dst.PostGet(post.ID); err == db.ErrNotFound {
+				logger.Printf("WARNING: post %s (%s) missing", HashID(post.ID), post.GUID)
+				missing += 1
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	reqs, err := src.RequestAll()
+	if err != nil {
+		return err
+	}
+	present, err := dst.RequestAll()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, req := range present {
+		known[req.URL] = true
+	}
+	for _, req := range reqs {
+		if !known[req.URL] {
+			logger.Printf("WARNING: request %s missing", req.URL)
+			missing += 1
+		}
+	}
+
+	if missing > 0 {
+		return fmt.Errorf("verification failed, %d records missing", missing)
+	}
+	logger.Printf("verified %d feeds, %d posts and %d requests", len(feeds), posts, len(reqs))
 	return nil
 }
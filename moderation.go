@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+/******************************************************************************
+ * Feed request moderation
+ * A request is approved by fetching and parsing the requested feed and adding
+ * it under a handle chosen by the moderator. Rejected feeds may be requested
+ * again, banned feeds may not. Every decision records who made it and when.
+ */
+
+const probeTimeout = 30 * time.Second
+
+// approveRequest validates the feed of the request for reqURL by fetching it
+// and adds it as handle.
+func approveRequest(store Storage, fd *FeedD, reqURL, handle, by string) (*Feed, error) {
+	if !handleRE.MatchString(handle) {
+		return nil, errors.New("invalid handle")
+	}
+	req, err := store.RequestGet(reqURL)
+	if err == db.ErrNotFound {
+		return nil, errors.New("no request for that url")
+	} else if err != nil {
+		return nil, err
+	}
+	if req.Status == db.RequestApproved {
+		return nil, fmt.Errorf("already approved as %s", req.Handle)
+	}
+
+	feeds, err := store.FeedAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, feed := range feeds {
+		if feed.Handle == handle {
+			return nil, fmt.Errorf("handle %s is taken", handle)
+		}
+		if feed.URL == reqURL {
+			return nil, fmt.Errorf("feed already exists as %s", feed.Handle)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	parsed, err := fd.Probe(ctx, reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch feed: %s", err.Error())
+	}
+
+	var feed Feed
+	feed.ID = MakeID()
+	feed.Handle = handle
+	feed.URL = reqURL
+	feed.Title = parsed.Title
+	feed.Link = parsed.Link
+	if parsed.Image != nil {
+		feed.ImageURL = parsed.Image.Url
+	}
+	if _, err = store.FeedAdd(&feed); err != nil {
+		return nil, err
+	}
+
+	req.Status = db.RequestApproved
+	req.DecidedBy = by
+	req.DecidedAt = time.Now()
+	req.Handle = handle
+	return &feed, store.RequestDecide(req)
+}
+
+// decideRequest rejects or bans the feed at reqURL. Only bans may be decided
+// for feeds nobody requested yet.
+func decideRequest(store Storage, reqURL, status, by string) error {
+	req, err := store.RequestGet(reqURL)
+	if err == db.ErrNotFound && status == db.RequestBanned {
+		req = &FeedReq{ID: MakeID(), URL: reqURL, Date: time.Now()}
+	} else if err == db.ErrNotFound {
+		return errors.New("no request for that url")
+	} else if err != nil {
+		return err
+	}
+	req.Status = status
+	req.DecidedBy = by
+	req.DecidedAt = time.Now()
+	req.Handle = ""
+	return store.RequestDecide(req)
+}
+
+// cliModerator names the moderator of decisions made on the command line.
+func cliModerator() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "cli"
+}
+
+func cmdAddRequest(address string) error {
+	if !ValidateURL(address) {
+		return errors.New("malformed feed request url")
+	}
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+	return conn.RequestAdd(MakeID(), address)
+}
+
+func cmdClearRequests() error {
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+	return conn.RequestRemoveAll()
+}
+
+func cmdListRequests(all bool) error {
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	reqs, err := conn.RequestAll()
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		switch {
+		case req.Pending():
+			fmt.Printf("%4d %s\n", req.N, req.URL)
+		case all && req.Status == db.RequestApproved:
+			fmt.Printf("%4d %s %s as %s by %s at %s\n", req.N, req.URL, req.Status,
+				req.Handle, req.DecidedBy, req.DecidedAt.Format("2006-01-02 15:04"))
+		case all:
+			fmt.Printf("%4d %s %s by %s at %s\n", req.N, req.URL, req.Status,
+				req.DecidedBy, req.DecidedAt.Format("2006-01-02 15:04"))
+		}
+	}
+	return nil
+}
+
+func cmdApproveRequest(address, handle string) error {
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	fd := NewFeedD(conn, 1, probeTimeout, 0, NewPrefixedLogger("feedd"))
+	feed, err := approveRequest(conn, fd, address, handle, cliModerator())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s as %s: %s\n", feed.URL, feed.Handle, feed.Title)
+	return nil
+}
+
+func cmdDecideRequest(address, status string) error {
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+	return decideRequest(conn, address, status, cliModerator())
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/******************************************************************************
+ * OPML
+ * Feed lists as exchanged between feed readers. Folders are mapped to feed
+ * categories, nested folders are joined with "/".
+ */
+
+type opmlDocument struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated,omitempty"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Category string        `xml:"category,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// opmlFeed is a feed found in an opml document.
+type opmlFeed struct {
+	Title    string
+	URL      string
+	Link     string
+	Category string
+}
+
+// ReadOPML returns all feeds of an opml document in document order.
+func ReadOPML(r io.Reader) ([]*opmlFeed, error) {
+	var doc opmlDocument
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	feeds := make([]*opmlFeed, 0)
+	var walk func(outlines []opmlOutline, folder string)
+	walk = func(outlines []opmlOutline, folder string) {
+		for _, o := range outlines {
+			title := o.Title
+			if title == "" {
+				title = o.Text
+			}
+			if o.XMLURL == "" {
+				// a folder
+				sub := title
+				if folder != "" {
+					sub = folder + "/" + title
+				}
+				walk(o.Outlines, sub)
+				continue
+			}
+			category := folder
+			if category == "" && o.Category != "" {
+				// first category of the outline, without leading slash
+				category = strings.Trim(strings.Split(o.Category, ",")[0], "/ ")
+			}
+			feeds = append(feeds, &opmlFeed{title, strings.TrimSpace(o.XMLURL), o.HTMLURL, category})
+		}
+	}
+	walk(doc.Body, "")
+	return feeds, nil
+}
+
+// opmlFolder collects the outlines of a folder while writing.
+type opmlFolder struct {
+	name     string
+	outlines []opmlOutline
+	folders  []*opmlFolder
+	byName   map[string]*opmlFolder
+}
+
+func (f *opmlFolder) folder(path string) *opmlFolder {
+	if path == "" {
+		return f
+	}
+	name, rest := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, rest = path[:i], path[i+1:]
+	}
+	sub, ok := f.byName[name]
+	if !ok {
+		sub = &opmlFolder{name: name, byName: make(map[string]*opmlFolder)}
+		f.byName[name] = sub
+		f.folders = append(f.folders, sub)
+	}
+	return sub.folder(rest)
+}
+
+// outline returns the folders followed by the feeds of f.
+func (f *opmlFolder) outline() []opmlOutline {
+	res := make([]opmlOutline, 0, len(f.folders)+len(f.outlines))
+	for _, sub := range f.folders {
+		res = append(res, opmlOutline{Text: sub.name, Title: sub.name, Outlines: sub.outline()})
+	}
+	return append(res, f.outlines...)
+}
+
+// WriteOPML writes feeds as opml document, feeds with a category are put
+// into folders.
+func WriteOPML(w io.Writer, feeds []*Feed) error {
+	root := &opmlFolder{byName: make(map[string]*opmlFolder)}
+	for _, feed := range feeds {
+		title := feed.Title
+		if title == "" {
+			title = feed.Handle
+		}
+		folder := root.folder(feed.Category)
+		folder.outlines = append(folder.outlines, opmlOutline{
+			Text:    title,
+			Title:   title,
+			Type:    "rss",
+			XMLURL:  feed.URL,
+			HTMLURL: feed.Link,
+		})
+	}
+	doc := opmlDocument{
+		Version: "2.0",
+		Title:   "go-news feeds",
+		Created: time.Now().Format(time.RFC1123Z),
+		Body:    root.outline(),
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+const handleMaxLength = 16
+
+// FeedHandle derives a handle matching handleRE from the title of a feed or,
+// failing that, from the host of its address. Handles in taken are avoided
+// by appending a number.
+func FeedHandle(title, address string, taken map[string]bool) string {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToLower(s) {
+			if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				continue
+			}
+			if b.Len() == 0 && !unicode.IsLetter(r) {
+				continue
+			}
+			b.WriteRune(r)
+		}
+		handle := b.String()
+		if len(handle) > handleMaxLength {
+			handle = handle[:handleMaxLength]
+		}
+		return handle
+	}
+
+	handle := clean(title)
+	if handle == "" {
+		if u, err := url.Parse(address); err == nil {
+			host := strings.TrimPrefix(u.Hostname(), "www.")
+			if i := strings.Index(host, "."); i > 0 {
+				host = host[:i]
+			}
+			handle = clean(host)
+		}
+	}
+	if handle == "" {
+		handle = "feed"
+	}
+	if !taken[handle] {
+		return handle
+	}
+	for i := 2; ; i += 1 {
+		suffix := strconv.Itoa(i)
+		base := handle
+		if len(base)+len(suffix) > handleMaxLength {
+			base = base[:handleMaxLength-len(suffix)]
+		}
+		if !taken[base+suffix] {
+			return base + suffix
+		}
+	}
+}
+
+func cmdImportOPML(file string, dryRun bool) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	entries, err := ReadOPML(in)
+	if err != nil {
+		return err
+	}
+
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	feeds, err := conn.FeedAll()
+	if err != nil {
+		return err
+	}
+	taken := make(map[string]bool)
+	byURL := make(map[string]*Feed)
+	for _, feed := range feeds {
+		taken[feed.Handle] = true
+		byURL[feed.URL] = feed
+	}
+
+	added, skipped, failed := 0, 0, 0
+	for _, entry := range entries {
+		if !ValidateURL(entry.URL) {
+			fmt.Printf("invalid  %s: not a valid address\n", entry.URL)
+			failed += 1
+			continue
+		}
+		if feed, ok := byURL[entry.URL]; ok {
+			fmt.Printf("exists   %s as %s\n", entry.URL, feed.Handle)
+			skipped += 1
+			continue
+		}
+		var feed Feed
+		feed.ID = MakeID()
+		feed.Handle = FeedHandle(entry.Title, entry.URL, taken)
+		feed.Title = entry.Title
+		feed.Link = entry.Link
+		feed.URL = entry.URL
+		feed.Category = entry.Category
+		if !dryRun {
+			if _, err := conn.FeedAdd(&feed); err != nil {
+				fmt.Printf("failed   %s: %s\n", entry.URL, err.Error())
+				failed += 1
+				continue
+			}
+		}
+		taken[feed.Handle] = true
+		byURL[feed.URL] = &feed
+		if feed.Category != "" {
+			fmt.Printf("add      %s as %s in %s\n", feed.URL, feed.Handle, feed.Category)
+		} else {
+			fmt.Printf("add      %s as %s\n", feed.URL, feed.Handle)
+		}
+		added += 1
+	}
+
+	verb := "added"
+	if dryRun {
+		verb = "would add"
+	}
+	fmt.Printf("%s %d feeds, %d already present, %d failed\n", verb, added, skipped, failed)
+	if failed > 0 {
+		return errors.New("some feeds could not be imported")
+	}
+	return nil
+}
+
+func cmdExportOPML(file string) error {
+	conn, err := OpenStorage(*appDbUri)
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	feeds, err := conn.FeedAll()
+	if err != nil {
+		return err
+	}
+	if file == "" || file == "-" {
+		return WriteOPML(os.Stdout, feeds)
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err = WriteOPML(out, feeds); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
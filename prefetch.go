@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"log"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+/******************************************************************************
+ * Article prefetching
+ * FeedD hands new posts of feeds with prefetching enabled to the prefetcher,
+ * which extracts their articles in the background so the first reader does
+ * not wait for them. Requests to the same host are spaced by a delay, jobs
+ * whose host is not due yet are put back until it is, so workers are free for
+ * other hosts in the meantime. Failed extractions are retried with growing
+ * pauses. Posts already waiting and
+ * posts given up on are not queued again.
+ */
+
+const (
+	// posts waiting to be prefetched, more are dropped
+	prefetchQueue = 1024
+	// attempts per article, and the pause before the first retry, which
+	// doubles with every further one
+	prefetchAttempts = 3
+	prefetchBackoff  = time.Minute
+	// how long posts given up on are not queued again
+	prefetchForget = 24 * time.Hour
+)
+
+// PrefetchCounts describes the work of the prefetcher since the start.
+type PrefetchCounts struct {
+	Queued  int // posts waiting, including retries
+	Fetched int // articles extracted
+	Retried int // failed attempts that were retried
+	Failed  int // articles given up on
+	Dropped int // posts dropped because the queue was full
+}
+
+type prefetchJob struct {
+	post    *Post
+	attempt int
+	// the slot reserved for the request to the host of the post, zero until
+	// the job is first picked up
+	due time.Time
+}
+
+type Prefetcher struct {
+	active   bool
+	articles *Articles
+	log      *log.Logger
+
+	// number of articles fetched concurrently
+	workers int
+	// minimum time between two requests to the same host
+	delay time.Duration
+
+	jobs chan *prefetchJob
+	stop chan bool
+	wg   sync.WaitGroup
+
+	// guarded by lock. pending holds the posts queued, waiting for a retry
+	// or being extracted, failed when the posts given up on failed.
+	hosts   map[string]time.Time
+	pending map[int64]bool
+	failed  map[int64]time.Time
+	counts  PrefetchCounts
+	lock    sync.Mutex
+}
+
+func NewPrefetcher(articles *Articles, workers int, delay time.Duration, log *log.Logger) *Prefetcher {
+	res := &Prefetcher{}
+	res.articles = articles
+	res.log = log
+	res.workers = workers
+	res.delay = delay
+	res.jobs = make(chan *prefetchJob, prefetchQueue)
+	res.hosts = make(map[string]time.Time)
+	res.pending = make(map[int64]bool)
+	res.failed = make(map[int64]time.Time)
+	return res
+}
+
+func (p *Prefetcher) Start() error {
+	if p.active {
+		return errors.New("already running")
+	}
+	if p.workers < 1 {
+		return errors.New("prefetching needs at least one worker")
+	}
+	p.stop = make(chan bool)
+	p.active = true
+	for i := 0; i < p.workers; i += 1 {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return nil
+}
+
+func (p *Prefetcher) Stop() {
+	if p.active {
+		close(p.stop)
+		p.wg.Wait()
+		p.active = false
+	}
+}
+
+// Counts returns a snapshot of the prefetcher's counters.
+func (p *Prefetcher) Counts() PrefetchCounts {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.counts
+}
+
+// Enqueue schedules the articles of posts to be extracted. It never blocks,
+// posts that do not fit into the queue are dropped. Posts that are already
+// pending or were given up on recently are skipped.
+func (p *Prefetcher) Enqueue(posts []*Post) {
+	for _, post := range posts {
+		p.lock.Lock()
+		_, failed := p.failed[post.ID]
+		skip := p.pending[post.ID] || failed
+		if !skip {
+			p.pending[post.ID] = true
+		}
+		p.lock.Unlock()
+		if !skip {
+			p.enqueue(&prefetchJob{post: post})
+		}
+	}
+}
+
+func (p *Prefetcher) enqueue(job *prefetchJob) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case p.jobs <- job:
+		p.counts.Queued += 1
+	default:
+		p.counts.Dropped += 1
+		delete(p.pending, job.post.ID)
+	}
+}
+
+// reserve books the next slot for a request to host and returns how long to
+// wait for it.
+func (p *Prefetcher) reserve(host string) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if len(p.hosts) > prefetchQueue {
+		for h, next := range p.hosts {
+			if next.Before(now) {
+				delete(p.hosts, h)
+			}
+		}
+	}
+	next := p.hosts[host]
+	if next.Before(now) {
+		next = now
+	}
+	p.hosts[host] = next.Add(p.delay)
+	return next.Sub(now)
+}
+
+// work extracts queued articles until the prefetcher is stopped.
+func (p *Prefetcher) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case job := <-p.jobs:
+			p.lock.Lock()
+			p.counts.Queued -= 1
+			p.lock.Unlock()
+			p.run(job)
+		}
+	}
+}
+
+// later puts job back into the queue after d. The caller holds the lock.
+func (p *Prefetcher) later(d time.Duration, job *prefetchJob) {
+	p.counts.Queued += 1
+	time.AfterFunc(d, func() {
+		p.lock.Lock()
+		p.counts.Queued -= 1
+		p.lock.Unlock()
+		p.enqueue(job)
+	})
+}
+
+// run extracts the article of a job if its host is due, and otherwise puts
+// the job back until it is.
+func (p *Prefetcher) run(job *prefetchJob) {
+	if job.due.IsZero() {
+		host := ""
+		if u, err := neturl.Parse(job.post.Link); err == nil {
+			host = u.Host
+		}
+		job.due = time.Now().Add(p.reserve(host))
+	}
+	if wait := time.Until(job.due); wait > 0 {
+		p.lock.Lock()
+		p.later(wait, job)
+		p.lock.Unlock()
+		return
+	}
+
+	err := p.articles.Prefetch(job.post)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case err == nil:
+		p.counts.Fetched += 1
+		delete(p.pending, job.post.ID)
+	case job.attempt+1 < prefetchAttempts:
+		p.counts.Retried += 1
+		p.later(prefetchBackoff<<uint(job.attempt), &prefetchJob{post: job.post, attempt: job.attempt + 1})
+	default:
+		p.counts.Failed += 1
+		delete(p.pending, job.post.ID)
+		p.forget()
+		p.failed[job.post.ID] = time.Now()
+		p.log.Printf("WARNING: giving up on %s: %s", HashID(job.post.ID), err.Error())
+	}
+}
+
+// forget drops the posts given up on longer than prefetchForget ago once
+// there are many of them. The caller holds the lock.
+func (p *Prefetcher) forget() {
+	if len(p.failed) < prefetchQueue {
+		return
+	}
+	now := time.Now()
+	for id, failed := range p.failed {
+		if now.Sub(failed) > prefetchForget {
+			delete(p.failed, id)
+		}
+	}
+}
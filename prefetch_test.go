@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrefetchSkipsKnownPosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer server.Close()
+
+	s := storageBackends["sqlite3"](t)
+	defer s.Disconnect()
+	feed := addTestFeed(t, s, "a")
+	post := testPost(feed.ID, "gone", time.Now())
+	post.Link = server.URL + "/gone"
+	addTestPosts(t, s, post)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	p := NewPrefetcher(NewArticles(s, logger), 1, 0, logger)
+
+	// the prefetcher is not started, so the post stays queued
+	p.Enqueue([]*Post{post})
+	p.Enqueue([]*Post{post})
+	if counts := p.Counts(); counts.Queued != 1 {
+		t.Fatalf("queued %d jobs for the same post, want 1", counts.Queued)
+	}
+
+	// once given up on, the post is not queued again
+	job := <-p.jobs
+	job.attempt = prefetchAttempts - 1
+	p.run(job)
+	p.Enqueue([]*Post{post})
+	if counts := p.Counts(); counts.Failed != 1 || len(p.jobs) != 0 {
+		t.Errorf("after giving up: %+v, %d jobs queued", counts, len(p.jobs))
+	}
+}
+
+func TestPrefetchHostsDoNotStarve(t *testing.T) {
+	slow := make(chan string, 16)
+	other := make(chan string, 1)
+	serve := func(hits chan string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits <- r.URL.Path
+			fmt.Fprint(w, testArticle)
+		}))
+	}
+	slowServer, otherServer := serve(slow), serve(other)
+	defer slowServer.Close()
+	defer otherServer.Close()
+
+	s := storageBackends["sqlite3"](t)
+	defer s.Disconnect()
+	feed := addTestFeed(t, s, "a")
+	now := time.Now()
+	posts := make([]*Post, 0)
+	for i := 0; i < 10; i++ {
+		post := testPost(feed.ID, fmt.Sprintf("slow%d", i), now.Add(-time.Duration(i)*time.Second))
+		post.Link = slowServer.URL + "/" + post.GUID
+		posts = append(posts, post)
+	}
+	last := testPost(feed.ID, "other", now.Add(-time.Minute))
+	last.Link = otherServer.URL + "/" + last.GUID
+	posts = append(posts, last)
+	addTestPosts(t, s, posts...)
+
+	// the articles of the first host take 4.5 seconds, two workers blocking
+	// on it would only get to the other host after all of them
+	const delay = 500 * time.Millisecond
+	logger := log.New(ioutil.Discard, "", 0)
+	p := NewPrefetcher(NewArticles(s, logger), 2, delay, logger)
+	p.Enqueue(posts)
+	start := time.Now()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	select {
+	case <-other:
+		if waited := time.Since(start); waited > delay {
+			t.Errorf("other host was fetched after %s", waited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("other host was not fetched")
+	}
+	if n := len(slow); n > 2 {
+		t.Errorf("first host was fetched %d times within its delay", n)
+	}
+}
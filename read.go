@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+/******************************************************************************
+ * Read state
+ * Posts opened at /a/ are marked as read. Logged in users keep their read
+ * state with their account, everyone else with a random reader id stored in
+ * a cookie. Anonymous reader ids are negative so they never collide with
+ * account ids. Forms of anonymous readers carry a csrf token derived from
+ * their reader id.
+ */
+
+const (
+	readerCookie   = "reader"
+	readerLifetime = 365 * 24 * time.Hour
+
+	// how many pages are looked through to fill a page of unread posts
+	unreadMaxPages = 10
+)
+
+// readerID returns the id the read state of the request is kept under, 0 for
+// anonymous readers without a cookie unless create is set, in which case
+// they are given one.
+func readerID(c *gin.Context, create bool) (int64, error) {
+	if sess := currentSession(c); sess != nil && sess.Account != 0 {
+		return sess.Account, nil
+	}
+	if v, err := c.Cookie(readerCookie); err == nil {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil && id < 0 {
+			return id, nil
+		}
+	}
+	if !create {
+		return 0, nil
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	id := int64(binary.BigEndian.Uint64(b[:]) | 1<<63)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     readerCookie,
+		Value:    strconv.FormatInt(id, 10),
+		Path:     *serveBaseUrl + "/",
+		Expires:  time.Now().Add(readerLifetime),
+		HttpOnly: true,
+		Secure:   secureRequest(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// readerKey signs the csrf tokens of anonymous readers. It is not kept, forms
+// rendered before a restart have to be reloaded.
+var readerKey = func() []byte {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return b[:]
+}()
+
+// readerCSRF returns the csrf token of the anonymous reader with the given id.
+func readerCSRF(reader int64) string {
+	mac := hmac.New(sha256.New, readerKey)
+	mac.Write([]byte(strconv.FormatInt(reader, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// formCSRF returns the csrf token forms of the request must send along, the
+// one of the session or, for anonymous readers, the one of their reader id.
+// Readers without a cookie are given one.
+func formCSRF(c *gin.Context) (string, error) {
+	if sess := currentSession(c); sess != nil {
+		return sess.CSRF, nil
+	}
+	reader, err := readerID(c, true)
+	if err != nil {
+		return "", err
+	}
+	return readerCSRF(reader), nil
+}
+
+// validFormCSRF is validCSRF for requests with or without a session.
+func validFormCSRF(c *gin.Context) bool {
+	if sess := currentSession(c); sess != nil {
+		return validCSRF(c, sess)
+	}
+	reader, err := readerID(c, false)
+	if err != nil || reader == 0 {
+		return false
+	}
+	token := c.PostForm("csrf")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(readerCSRF(reader))) == 1
+}
+
+// readState returns the read state of the request, empty for readers
+// without a cookie.
+func readState(c *gin.Context) (*ReadState, error) {
+	reader, err := readerID(c, false)
+	if err != nil || reader == 0 {
+		return db.NewReadState(), err
+	}
+	return store.ReadStateGet(reader)
+}
+
+// readPosts returns the ids of the read posts in posts.
+func readPosts(posts []*Post, state *ReadState) map[int64]bool {
+	read := make(map[int64]bool)
+	for _, post := range posts {
+		if state.IsRead(post) {
+			read[post.ID] = true
+		}
+	}
+	return read
+}
+
+// unreadPage is PostPage for unread posts. It gives up after looking through
+// unreadMaxPages pages, so the page may be short even if there are older
+// unread posts.
+func unreadPage(n int, before int64, feeds []int64, state *ReadState) ([]*Post, error) {
+	res := make([]*Post, 0, n)
+	for i := 0; i < unreadMaxPages && len(res) < n; i++ {
+		posts, err := store.PostPage(n, before, feeds)
+		if err != nil {
+			return nil, err
+		}
+		for _, post := range posts {
+			if !state.IsRead(post) && len(res) < n {
+				res = append(res, post)
+			}
+		}
+		if len(posts) < n {
+			break
+		}
+		before = posts[len(posts)-1].ID
+	}
+	return res, nil
+}
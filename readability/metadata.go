@@ -0,0 +1,208 @@
+package readability
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Metadata describes an article as announced by the page itself. Fields the
+// page does not provide are left empty.
+type Metadata struct {
+	Title       string    `json:"title,omitempty"`
+	Byline      string    `json:"byline,omitempty"`
+	Published   time.Time `json:"published"`
+	SiteName    string    `json:"site_name,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Language    string    `json:"language,omitempty"`
+}
+
+// layouts of published dates found in the wild, tried in order
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// Metadata extracts the metadata of the article from JSON-LD, OpenGraph,
+// Twitter cards and plain <meta> tags, preferring them in that order.
+func (d *Document) Metadata() *Metadata {
+	// Content rewrites the document, so start over from the input
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(d.input))
+	if err != nil {
+		return &Metadata{}
+	}
+
+	meta := make(map[string]string)
+	doc.Find("meta").Each(func(i int, s *goquery.Selection) {
+		content := strings.TrimSpace(s.AttrOr("content", ""))
+		if content == "" {
+			return
+		}
+		for _, attr := range []string{"property", "name", "itemprop", "http-equiv"} {
+			key := strings.ToLower(strings.TrimSpace(s.AttrOr(attr, "")))
+			if _, ok := meta[key]; key != "" && !ok {
+				meta[key] = content
+			}
+		}
+	})
+	ld := jsonLDArticle(doc)
+
+	m := &Metadata{}
+	m.Title = first(ld.str("headline"), ld.str("name"), meta["og:title"], meta["twitter:title"],
+		meta["title"], strings.TrimSpace(doc.Find("title").First().Text()))
+	m.Byline = first(ld.names("author"), meta["author"], notURL(meta["article:author"]),
+		meta["twitter:creator"])
+	m.SiteName = first(meta["og:site_name"], ld.names("publisher"), meta["application-name"],
+		meta["twitter:site"])
+	m.Image = first(ld.url("image"), meta["og:image"], meta["og:image:url"], meta["twitter:image"],
+		meta["twitter:image:src"])
+	m.Description = first(ld.str("description"), meta["og:description"], meta["twitter:description"],
+		meta["description"])
+	m.Language = first(ld.str("inLanguage"), strings.TrimSpace(doc.Find("html").AttrOr("lang", "")),
+		meta["content-language"], strings.Replace(meta["og:locale"], "_", "-", -1))
+	m.Published = parseDate(first(ld.str("datePublished"), meta["article:published_time"],
+		meta["datepublished"], meta["date"], meta["pubdate"], meta["publish-date"], meta["dc.date"]))
+	return m
+}
+
+// first returns the first non-empty value.
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// notURL drops values that are links to profile pages rather than names.
+func notURL(v string) string {
+	if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+		return ""
+	}
+	return v
+}
+
+func parseDate(v string) time.Time {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ldObject is a decoded JSON-LD object.
+type ldObject map[string]interface{}
+
+// jsonLDArticle returns the first article object of the JSON-LD blocks of
+// doc, nil if there is none.
+func jsonLDArticle(doc *goquery.Document) ldObject {
+	var res ldObject
+	doc.Find(`script[type="application/ld+json"]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s.Text()), &v); err != nil {
+			return true
+		}
+		res = findArticle(v)
+		return res == nil
+	})
+	return res
+}
+
+// findArticle searches v, its arrays and @graph lists for an object of an
+// article type.
+func findArticle(v interface{}) ldObject {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if o := findArticle(e); o != nil {
+				return o
+			}
+		}
+	case map[string]interface{}:
+		o := ldObject(v)
+		if isArticleType(o["@type"]) {
+			return o
+		}
+		return findArticle(o["@graph"])
+	}
+	return nil
+}
+
+// isArticleType reports whether t names one of the schema.org article types,
+// Article itself, NewsArticle, BlogPosting and so on.
+func isArticleType(t interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return strings.HasSuffix(t, "Article") || t == "BlogPosting"
+	case []interface{}:
+		for _, e := range t {
+			if isArticleType(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// str returns the string value of key.
+func (o ldObject) str(key string) string {
+	if s, ok := o[key].(string); ok {
+		return strings.TrimSpace(s)
+	}
+	return ""
+}
+
+// names returns the names of key, which may be a plain string, a person or
+// organization, or a list of those.
+func (o ldObject) names(key string) string {
+	var names []string
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			if v = notURL(strings.TrimSpace(v)); v != "" {
+				names = append(names, v)
+			}
+		case map[string]interface{}:
+			collect(v["name"])
+		case []interface{}:
+			for _, e := range v {
+				collect(e)
+			}
+		}
+	}
+	collect(o[key])
+	return strings.Join(names, ", ")
+}
+
+// url returns the first url of key, which may be a plain string, an object
+// with an url, or a list of those.
+func (o ldObject) url(key string) string {
+	var find func(v interface{}) string
+	find = func(v interface{}) string {
+		switch v := v.(type) {
+		case string:
+			return strings.TrimSpace(v)
+		case map[string]interface{}:
+			return find(v["url"])
+		case []interface{}:
+			for _, e := range v {
+				if u := find(e); u != "" {
+					return u
+				}
+			}
+		}
+		return ""
+	}
+	return find(o[key])
+}
@@ -0,0 +1,214 @@
+package readability
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// allowedTags maps the elements kept by Sanitize to the attributes they keep,
+// everything else is dropped.
+var allowedTags = map[string][]string{
+	"a":          {"href", "title"},
+	"abbr":       {"title"},
+	"b":          nil,
+	"blockquote": {"cite"},
+	"br":         nil,
+	"caption":    nil,
+	"cite":       nil,
+	"code":       nil,
+	"dd":         nil,
+	"del":        nil,
+	"div":        nil,
+	"dl":         nil,
+	"dt":         nil,
+	"em":         nil,
+	"figcaption": nil,
+	"figure":     nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"hr":         nil,
+	"i":          nil,
+	"img":        {"src", "alt", "title", "width", "height"},
+	"ins":        nil,
+	"li":         nil,
+	"mark":       nil,
+	"ol":         {"start"},
+	"p":          nil,
+	"pre":        nil,
+	"q":          {"cite"},
+	"s":          nil,
+	"small":      nil,
+	"span":       nil,
+	"strong":     nil,
+	"sub":        nil,
+	"sup":        nil,
+	"table":      nil,
+	"tbody":      nil,
+	"td":         {"colspan", "rowspan"},
+	"tfoot":      nil,
+	"th":         {"colspan", "rowspan"},
+	"thead":      nil,
+	"time":       {"datetime"},
+	"tr":         nil,
+	"u":          nil,
+	"ul":         nil,
+}
+
+// droppedTags are removed together with their content, other elements that
+// are not allowed are replaced by their children.
+var droppedTags = map[string]bool{
+	"applet":   true,
+	"base":     true,
+	"button":   true,
+	"embed":    true,
+	"form":     true,
+	"frame":    true,
+	"frameset": true,
+	"head":     true,
+	"iframe":   true,
+	"input":    true,
+	"link":     true,
+	"math":     true,
+	"meta":     true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"select":   true,
+	"style":    true,
+	"svg":      true,
+	"template": true,
+	"textarea": true,
+	"title":    true,
+}
+
+// urlAttrs are the attributes holding urls, they are resolved against the
+// base url and only kept with an allowed scheme.
+var urlAttrs = map[string]bool{
+	"cite": true,
+	"href": true,
+	"src":  true,
+}
+
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// Sanitize returns the html fragment s with only allowlisted elements,
+// attributes and url schemes left. Relative urls are resolved against base
+// if it is not nil, and dropped otherwise.
+func Sanitize(s string, base *url.URL) string {
+	context := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(s), context)
+	if err != nil {
+		Logger.Println("Unable to parse content", err)
+		return ""
+	}
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, clean := range sanitizeNode(n, base) {
+			if err := html.Render(&buf, clean); err != nil {
+				Logger.Println("Unable to render content", err)
+				return ""
+			}
+		}
+	}
+	return buf.String()
+}
+
+// sanitizeNode returns the nodes n is replaced with, detached from their
+// parents.
+func sanitizeNode(n *html.Node, base *url.URL) []*html.Node {
+	if n.Type == html.TextNode {
+		return []*html.Node{{Type: html.TextNode, Data: n.Data}}
+	}
+	// comments and doctypes
+	if n.Type != html.ElementNode {
+		return nil
+	}
+
+	tag := strings.ToLower(n.Data)
+	if droppedTags[tag] {
+		return nil
+	}
+	var children []*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		children = append(children, sanitizeNode(c, base)...)
+	}
+	attrs, ok := allowedTags[tag]
+	if !ok || n.Namespace != "" {
+		return children
+	}
+
+	res := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !contains(attrs, key) {
+			continue
+		}
+		val := attr.Val
+		if urlAttrs[key] {
+			if val = sanitizeURL(val, base); val == "" {
+				continue
+			}
+		}
+		res.Attr = append(res.Attr, html.Attribute{Key: key, Val: val})
+	}
+	if tag == "a" {
+		res.Attr = append(res.Attr, html.Attribute{Key: "rel", Val: "nofollow noopener noreferrer"})
+	}
+	// images without a source are of no use
+	if tag == "img" && !hasAttr(res, "src") {
+		return nil
+	}
+	for _, c := range children {
+		res.AppendChild(c)
+	}
+	return []*html.Node{res}
+}
+
+// sanitizeURL returns the absolute form of v, or "" if it can not be parsed
+// or has a scheme that is not allowed.
+func sanitizeURL(v string, base *url.URL) string {
+	u, err := url.Parse(strings.TrimSpace(v))
+	if err != nil {
+		return ""
+	}
+	if !u.IsAbs() {
+		if base == nil {
+			return ""
+		}
+		u = base.ResolveReference(u)
+	}
+	if !allowedSchemes[strings.ToLower(u.Scheme)] {
+		return ""
+	}
+	return u.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package readability
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	base, err := url.Parse("https://example.com/news/a.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rel = ` rel="nofollow noopener noreferrer"`
+
+	tests := []struct {
+		name string
+		in   string
+		base *url.URL
+		want string
+	}{
+		// event handlers
+		{"onerror", `<img src=x onerror=alert(1)>`, base, `<img src="https://example.com/news/x"/>`},
+		{"onload", `<body onload=alert(1)><p>ok</p></body>`, base, `<p>ok</p>`},
+		{"onclick", `<p onclick="x()" onmouseover="y()">hi</p>`, nil, `<p>hi</p>`},
+		{"style attribute", `<div style="background:url(x)">x</div>`, nil, `<div>x</div>`},
+
+		// url schemes
+		{"javascript href", `<a href="javascript:alert(1)">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"mixed case javascript", `<a href="JaVaScRiPt:alert(1)">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"padded javascript", `<a href="  javascript:alert(1)  ">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"tab in javascript", "<a href=\"java\tscript:alert(1)\">x</a>", base, `<a` + rel + `>x</a>`},
+		{"decimal entity javascript", `<a href="&#106;avascript:alert(1)">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"hex entity javascript", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"named entity javascript", `<a href="javascript&colon;alert(1)">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"javascript cite", `<blockquote cite="javascript:alert(1)">q</blockquote>`, base, `<blockquote>q</blockquote>`},
+		{"data href", `<a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"data src", `<img src="data:image/svg+xml,<svg onload=alert(1)>">`, base, ``},
+		{"upper case data src", `<img src="DATA:image/png;base64,AAAA">`, base, ``},
+		{"vbscript href", `<a href="vbscript:msgbox(1)">x</a>`, base, `<a` + rel + `>x</a>`},
+		{"padded mixed case vbscript src", `<img src=" VBScript:msgbox(1)">`, base, ``},
+		{"mailto", `<a href="mailto:a@example.com">m</a>`, nil, `<a href="mailto:a@example.com"` + rel + `>m</a>`},
+
+		// dropped elements
+		{"iframe", `<iframe src="https://example.org/"></iframe>`, base, ``},
+		{"form", `<form action="https://example.org/"><input name=a><button>go</button></form>`, base, ``},
+		{"svg", `<svg onload=alert(1)><a href="https://example.org/">y</a></svg>`, base, ``},
+		{"svg script", `<svg><script>alert(1)</script></svg>`, base, ``},
+		{"math", `<math><mtext><script>alert(1)</script></mtext></math>`, base, ``},
+		{"style", `<style>body{background:url(javascript:alert(1))}</style><p>a</p>`, base, `<p>a</p>`},
+		{"script", `<script>alert(1)</script>b`, base, `b`},
+		{"noscript", `<noscript><img src=x onerror=alert(1)></noscript>`, base, ``},
+
+		// raw text elements are unwrapped, their content stays text
+		{"xmp", `<xmp><script>alert(1)</script></xmp>`, base, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+		{"noembed", `<noembed><img src=x onerror=alert(1)></noembed>`, base, `&lt;img src=x onerror=alert(1)&gt;`},
+		{"plaintext", `<plaintext><script>alert(1)</script>`, base, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+
+		// relative urls
+		{"relative href without base", `<a href="/b?x=1&y=2">x</a>`, nil, `<a` + rel + `>x</a>`},
+		{"relative src without base", `<img src="img/p.png" alt="p">`, nil, ``},
+		{"absolute href without base", `<a href="https://example.org/">x</a>`, nil, `<a href="https://example.org/"` + rel + `>x</a>`},
+		{"root relative href", `<a href="/b?x=1&y=2">x</a>`, base, `<a href="https://example.com/b?x=1&amp;y=2"` + rel + `>x</a>`},
+		{"relative href", `<a href="b">x</a>`, base, `<a href="https://example.com/news/b"` + rel + `>x</a>`},
+		{"relative src", `<img src="img/p.png" alt="p">`, base, `<img src="https://example.com/news/img/p.png" alt="p"/>`},
+		{"scheme relative href", `<a href="//example.org" target=_blank>x</a>`, base, `<a href="https://example.org"` + rel + `>x</a>`},
+
+		// rel is forced on links
+		{"rel replaced", `<a href="https://example.org/" rel="opener">x</a>`, nil, `<a href="https://example.org/"` + rel + `>x</a>`},
+		{"rel without href", `<a>x</a>`, nil, `<a` + rel + `>x</a>`},
+	}
+	for _, test := range tests {
+		if got := Sanitize(test.in, test.base); got != test.want {
+			t.Errorf("%s: Sanitize(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
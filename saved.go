@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	neturl "net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+/******************************************************************************
+ * Saved posts
+ * Logged in users save posts from the article page. Saved posts and their
+ * content are kept regardless of PostsMaxAge, listed at /saved/ and exported
+ * as /saved/saved.atom or /saved/saved.rss, with ?content=1 including the
+ * articles.
+ */
+
+// isSaved reports whether the logged in user of the request saved post.
+func isSaved(c *gin.Context, post *Post) (bool, error) {
+	sess := currentSession(c)
+	if sess == nil || sess.Account == 0 {
+		return false, nil
+	}
+	return store.SavedHas(sess.Account, post.ID)
+}
+
+func registerSaved(r *gin.Engine, url func(string) string) {
+	saved := r.Group(url("/saved"), requireUser(url("/u/login")+"?next="+neturl.QueryEscape(url("/saved/"))))
+
+	saved.GET("/", func(c *gin.Context) {
+		sess := c.MustGet("session").(*Session)
+		posts, err := store.SavedAll(sess.Account)
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		c.HTML(200, "saved.tmpl", gin.H{"session": sess, "posts": posts, "feeds": feedsByID(feeds)})
+	})
+
+	saved.GET("/:file", func(c *gin.Context) {
+		name, format := syndicationFormat(c.Param("file"))
+		if name != "saved" || format == "" {
+			c.String(http.StatusNotFound, "no such export, try saved.atom or saved.rss")
+			return
+		}
+		sess := c.MustGet("session").(*Session)
+		posts, err := store.SavedAll(sess.Account)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal error")
+			return
+		}
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal error")
+			return
+		}
+		writeSyndication(c, format, "news : saved by "+sess.Name, c.Request.URL.Path, url("/saved/"),
+			posts, feedsByID(feeds))
+	})
+
+	// savedPost resolves the :articleid parameter for accounts, it answers
+	// the request itself if that fails.
+	savedPost := func(c *gin.Context) (*Session, *Post, bool) {
+		sess := c.MustGet("session").(*Session)
+		if sess.Account == 0 {
+			c.String(200, "the admin token can not save posts, log in with an account")
+			return nil, nil, false
+		}
+		post, err := store.PostGet(UnhashID(c.Param("articleid")))
+		if err == db.ErrNotFound {
+			c.String(200, "invalid article: "+c.Param("articleid"))
+			return nil, nil, false
+		} else if err != nil {
+			c.String(200, "Internal error")
+			return nil, nil, false
+		}
+		return sess, post, true
+	}
+
+	saved.POST("/:articleid", func(c *gin.Context) {
+		sess, post, ok := savedPost(c)
+		if !ok {
+			return
+		}
+		if err := store.SavedAdd(sess.Account, post.ID); err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		// keep the article with the post, it may be gone from its site later
+		if _, err := articles.Get(post); err != nil {
+			logger.Printf("WARNING: no content for saved %s: %s", HashID(post.ID), err.Error())
+		}
+		c.Redirect(http.StatusSeeOther, url("/a/"+HashID(post.ID)))
+	})
+
+	saved.POST("/:articleid/remove", func(c *gin.Context) {
+		sess, post, ok := savedPost(c)
+		if !ok {
+			return
+		}
+		if err := store.SavedRemove(sess.Account, post.ID); err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		if c.PostForm("back") == "saved" {
+			c.Redirect(http.StatusSeeOther, url("/saved/"))
+			return
+		}
+		c.Redirect(http.StatusSeeOther, url("/a/"+HashID(post.ID)))
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/******************************************************************************
+ * Feed schedule
+ * Every feed is polled on its own interval. The interval is learned from the
+ * posting frequency observed in the feed and never undercuts what the
+ * publisher asks for via <ttl>, sy:updatePeriod or Cache-Control.
+ */
+
+const (
+	pollMin     = time.Minute * 2
+	pollMax     = time.Hour
+	pollDefault = time.Minute * 15
+	pollHintMax = time.Hour * 24
+	backoffMax  = time.Hour * 24
+
+	// number of most recent posts used to estimate the posting frequency
+	pollSamples = 20
+)
+
+// pollInterval estimates the time until a feed should be polled again.
+// prev is the interval used so far (0 if unknown), dates are the publication
+// dates of the items currently in the feed (nil if the feed did not change)
+// and hint is the minimum interval requested by the publisher.
+func pollInterval(prev time.Duration, dates []time.Time, hint time.Duration) time.Duration {
+	interval := prev
+	if interval <= 0 {
+		interval = pollDefault
+	}
+	if dates == nil {
+		// not modified, back off slowly
+		interval += interval / 4
+	} else if period, ok := postingPeriod(dates); ok {
+		// aim for about two polls per posting period, smoothed over fetches
+		interval = (interval*3 + period/2) / 4
+	}
+	if interval < pollMin {
+		interval = pollMin
+	}
+	if interval > pollMax {
+		interval = pollMax
+	}
+	if hint > interval {
+		interval = hint
+		if interval > pollHintMax {
+			interval = pollHintMax
+		}
+	}
+	return interval
+}
+
+// backoffInterval returns the time until a feed that failed to fetch the
+// given number of times in a row should be retried.
+func backoffInterval(interval time.Duration, failures int) time.Duration {
+	if interval <= 0 {
+		interval = pollDefault
+	}
+	for i := 0; i < failures && interval < backoffMax; i += 1 {
+		interval *= 2
+	}
+	if interval > backoffMax {
+		interval = backoffMax
+	}
+	return interval
+}
+
+// postingPeriod returns the average time between the most recent posts. A
+// feed that has been silent for longer than that is treated as if it posted
+// once per silence.
+func postingPeriod(dates []time.Time) (time.Duration, bool) {
+	sorted := make([]time.Time, 0, len(dates))
+	for _, date := range dates {
+		if !date.IsZero() {
+			sorted = append(sorted, date)
+		}
+	}
+	if len(sorted) < 2 {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].After(sorted[j]) })
+	if len(sorted) > pollSamples {
+		sorted = sorted[:pollSamples]
+	}
+	newest := sorted[0]
+	oldest := sorted[len(sorted)-1]
+	period := newest.Sub(oldest) / time.Duration(len(sorted)-1)
+	if silence := time.Since(newest); silence > period {
+		period = silence
+	}
+	return period, true
+}
+
+// feedHints scans the channel header of a feed document for the update
+// schedule requested by the publisher via <ttl> or the syndication module.
+func feedHints(body []byte) time.Duration {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		// we only look at numbers and keywords, so any charset will do
+		return input, nil
+	}
+
+	var ttl, period time.Duration
+	frequency := 1
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == "item" || start.Name.Local == "entry" {
+			break
+		}
+		var value string
+		switch start.Name.Local {
+		case "ttl":
+			if dec.DecodeElement(&value, &start) != nil {
+				continue
+			}
+			if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+				ttl = time.Duration(n) * time.Minute
+			}
+		case "updatePeriod":
+			if dec.DecodeElement(&value, &start) != nil {
+				continue
+			}
+			switch strings.TrimSpace(value) {
+			case "hourly":
+				period = time.Hour
+			case "daily":
+				period = time.Hour * 24
+			case "weekly":
+				period = time.Hour * 24 * 7
+			case "monthly":
+				period = time.Hour * 24 * 30
+			case "yearly":
+				period = time.Hour * 24 * 365
+			}
+		case "updateFrequency":
+			if dec.DecodeElement(&value, &start) != nil {
+				continue
+			}
+			if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+				frequency = n
+			}
+		}
+	}
+
+	hint := ttl
+	if period > 0 && period/time.Duration(frequency) > hint {
+		hint = period / time.Duration(frequency)
+	}
+	return hint
+}
+
+// cacheMaxAge returns the max-age directive of a Cache-Control header.
+func cacheMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return 0
+}
+
+/******************************************************************************
+ * Feed queue
+ * Priority queue of feeds ordered by the time they are due to be polled.
+ */
+
+type queueItem struct {
+	feed  int64
+	due   time.Time
+	index int
+}
+
+type feedQueue struct {
+	items []*queueItem
+	byID  map[int64]*queueItem
+}
+
+func newFeedQueue() *feedQueue {
+	return &feedQueue{make([]*queueItem, 0), make(map[int64]*queueItem)}
+}
+
+func (q *feedQueue) Len() int           { return len(q.items) }
+func (q *feedQueue) Less(i, j int) bool { return q.items[i].due.Before(q.items[j].due) }
+func (q *feedQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *feedQueue) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(q.items)
+	q.items = append(q.items, item)
+	q.byID[item.feed] = item
+}
+
+func (q *feedQueue) Pop() interface{} {
+	n := len(q.items)
+	item := q.items[n-1]
+	q.items[n-1] = nil
+	q.items = q.items[:n-1]
+	delete(q.byID, item.feed)
+	return item
+}
+
+// Schedule adds the feed to the queue or moves it to its new due time.
+func (q *feedQueue) Schedule(feed int64, due time.Time) {
+	if item, ok := q.byID[feed]; ok {
+		item.due = due
+		heap.Fix(q, item.index)
+		return
+	}
+	heap.Push(q, &queueItem{feed: feed, due: due})
+}
+
+// Remove drops the feed from the queue if it is scheduled.
+func (q *feedQueue) Remove(feed int64) {
+	if item, ok := q.byID[feed]; ok {
+		heap.Remove(q, item.index)
+	}
+}
+
+func (q *feedQueue) Contains(feed int64) bool {
+	_, ok := q.byID[feed]
+	return ok
+}
+
+// IDs returns the ids of all scheduled feeds.
+func (q *feedQueue) IDs() []int64 {
+	ids := make([]int64, 0, len(q.items))
+	for _, item := range q.items {
+		ids = append(ids, item.feed)
+	}
+	return ids
+}
+
+// PopDue removes and returns at most n feeds that are due at time t.
+func (q *feedQueue) PopDue(t time.Time, n int) []int64 {
+	due := make([]int64, 0)
+	for len(due) < n && q.Len() > 0 && !q.items[0].due.After(t) {
+		due = append(due, heap.Pop(q).(*queueItem).feed)
+	}
+	return due
+}
+
+// Next returns the time the next feed is due, or false if the queue is empty.
+func (q *feedQueue) Next() (time.Time, bool) {
+	if q.Len() == 0 {
+		return time.Time{}, false
+	}
+	return q.items[0].due, true
+}
@@ -30,6 +30,7 @@ type Stats struct {
 
 func NewStats(log *log.Logger) *Stats {
 	s := Stats{}
+	s.visitors = make(map[string]int)
 	s.stop = make(chan bool)
 	s.log = log
 	s.fraction = 10 / 60.0
@@ -89,6 +90,29 @@ func (s *Stats) AddReadability(num int) {
 	s.readability += num
 }
 
+// StatsRates are the hourly rates of a Stats at one point in time.
+type StatsRates struct {
+	VisitsPerHour      float32
+	VisitorsPerHour    float32
+	PostsPerHour       float32
+	PostsReadPerHour   float32
+	ReadabilityPerHour float32
+}
+
+// Rates returns the current hourly rates.
+func (s *Stats) Rates() StatsRates {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return StatsRates{
+		VisitsPerHour:      s.VisitsPerHour,
+		VisitorsPerHour:    s.VisitorsPerHour,
+		PostsPerHour:       s.PostsPerHour,
+		PostsReadPerHour:   s.PostsReadPerHour,
+		ReadabilityPerHour: s.ReadabilityPerHour,
+	}
+}
+
 func (s *Stats) Stop() {
 	s.stop <- true
 	s.active = false
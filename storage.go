@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+// Storage is implemented by every storage backend, the bolt Store and the sql
+// db.DB. Lookups of things that do not exist return db.ErrNotFound, content
+// that has not been stored yet db.ErrNoContent.
+type Storage interface {
+	Disconnect()
+
+	// feeds, returned ordered by handle
+	FeedAdd(feed *Feed) (int64, error)
+	FeedUpdate(feed *Feed) error
+	FeedRemoveByHandleOrURL(handleOrURL string) (int64, error)
+	FeedGet(id int64) (*Feed, error)
+	FeedAll() ([]*Feed, error)
+
+	// posts, returned newest first
+	PostAddBatch(posts []*Post) ([]*Post, error)
+	PostGet(id int64) (*Post, error)
+	PostPage(n int, before int64, feeds []int64) ([]*Post, error)
+	PostTrim(before int64) (int64, error)
+	PostCounts() (map[int64]int64, error)
+	PostSearch(q *db.Query, n int, before int64) ([]*Post, error)
+
+	// readability content of posts
+	PostFetchContent(post *Post) error
+	PostStoreContent(post *Post) error
+
+	// feed requests, returned most requested first
+	RequestAdd(id int64, url string) error
+	RequestDecide(req *FeedReq) error
+	RequestGet(url string) (*FeedReq, error)
+	RequestAll() ([]*FeedReq, error)
+	RequestRemove(url string) error
+	RequestRemoveAll() error
+
+	// accounts, returned ordered by name
+	AccountAdd(account *Account) error
+	AccountUpdate(account *Account) error
+	AccountGet(name string) (*Account, error)
+	AccountAll() ([]*Account, error)
+
+	// ids of the feeds an account is subscribed to
+	SubscriptionAll(account int64) ([]int64, error)
+	SubscriptionSet(account int64, feeds []int64) error
+
+	// read state, per account or anonymous reader
+	ReadStateGet(reader int64) (*ReadState, error)
+	ReadStateMark(reader int64, post *Post) error
+	ReadStateMarkAll(reader int64, feeds []int64, until int64) error
+
+	// posts saved by accounts are exempt from PostTrim
+	SavedAdd(account, post int64) error
+	SavedRemove(account, post int64) error
+	SavedAll(account int64) ([]*Post, error)
+	SavedHas(account, post int64) (bool, error)
+}
+
+// splitStorageURI splits a storage uri into its scheme and the rest.
+func splitStorageURI(uri string) (string, string, error) {
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid storage uri %q, must be <scheme>://<source>", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+// OpenStorage opens the backend selected by the scheme of uri:
+// bolt://<path>, sqlite3://<path>, postgres://<user>@<host>/<database> or
+// mysql://tcp:<host>:<port>*<database>/<user>/<password>.
+func OpenStorage(uri string) (Storage, error) {
+	scheme, source, err := splitStorageURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "bolt":
+		store, err := NewStore(source, NewPrefixedLogger("store"))
+		if err != nil {
+			return nil, err
+		}
+		if version := store.CheckVersion(); version != storeVersion {
+			store.Disconnect()
+			return nil, fmt.Errorf("bolt database has version %s, expected %s", version, storeVersion)
+		}
+		return store, nil
+	case "sqlite3", "postgres", "mysql":
+		return db.Connect(uri)
+	default:
+		return nil, fmt.Errorf("unknown storage scheme %q", scheme)
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexander-matz/go-news/db"
+)
+
+// raceEnabled is set by race_test.go when testing with -race.
+var raceEnabled = false
+
+// storageBackends open an empty instance of every backend.
+var storageBackends = map[string]func(t *testing.T) Storage{
+	"bolt": func(t *testing.T) Storage {
+		if raceEnabled {
+			t.Skip("boltdb fails the pointer checks enabled with -race")
+		}
+		store, err := NewStore(filepath.Join(t.TempDir(), "data.bolt"), log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	},
+	"sqlite3": func(t *testing.T) Storage {
+		// an in-memory database shared by all connections of the pool
+		name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+		conn, err := db.Open("sqlite3://file:" + name + "?mode=memory&cache=shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	},
+}
+
+// TestStorage runs the conformance suite against every backend.
+func TestStorage(t *testing.T) {
+	suite := map[string]func(t *testing.T, s Storage){
+		"feeds":         testStorageFeeds,
+		"dedup":         testStorageDedup,
+		"paging":        testStoragePaging,
+		"trim":          testStorageTrim,
+		"content":       testStorageContent,
+		"requests":      testStorageRequests,
+		"accounts":      testStorageAccounts,
+		"subscriptions": testStorageSubscriptions,
+		"read state":    testStorageReadState,
+	}
+	for backend, open := range storageBackends {
+		for name, test := range suite {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				s := open(t)
+				defer s.Disconnect()
+				test(t, s)
+			})
+		}
+	}
+}
+
+// testPost returns a post of feed published at date.
+func testPost(feed int64, guid string, date time.Time) *Post {
+	return &Post{
+		ID:    NewIDGen(1).MakeIDFromTimestamp(date),
+		Feed:  feed,
+		GUID:  guid,
+		Title: "post " + guid,
+		Link:  "https://example.com/" + guid,
+		Date:  date,
+	}
+}
+
+func addTestFeed(t *testing.T, s Storage, handle string) *Feed {
+	feed := &Feed{ID: MakeID(), Handle: handle, URL: "https://example.com/" + handle + ".rss"}
+	if _, err := s.FeedAdd(feed); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func addTestPosts(t *testing.T, s Storage, posts ...*Post) {
+	inserted, err := s.PostAddBatch(posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != len(posts) {
+		t.Fatalf("inserted %d of %d posts", len(inserted), len(posts))
+	}
+}
+
+func postIDs(posts []*Post) []int64 {
+	ids := []int64{}
+	for _, post := range posts {
+		ids = append(ids, post.ID)
+	}
+	return ids
+}
+
+func sameIDs(got, want []int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testStorageFeeds(t *testing.T, s Storage) {
+	b := addTestFeed(t, s, "b")
+	a := addTestFeed(t, s, "a")
+
+	all, err := s.FeedAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Handle != "a" || all[1].Handle != "b" {
+		t.Fatalf("FeedAll returned %v, want a and b", all)
+	}
+
+	b.Title = "Feed B"
+	b.ETag = `"abc"`
+	b.Failures = 2
+	b.Prefetch = true
+	if err := s.FeedUpdate(b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.FeedGet(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != b.Title || got.ETag != b.ETag || got.Failures != 2 || !got.Prefetch {
+		t.Errorf("FeedGet returned %+v after update", got)
+	}
+	// updates that change nothing still find the feed
+	if err := s.FeedUpdate(b); err != nil {
+		t.Errorf("repeating an update returned %v", err)
+	}
+	if err := s.FeedUpdate(&Feed{ID: MakeID(), Handle: "c"}); err != db.ErrNotFound {
+		t.Errorf("updating a missing feed returned %v, want ErrNotFound", err)
+	}
+
+	if _, err := s.FeedRemoveByHandleOrURL("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FeedRemoveByHandleOrURL(b.URL); err != nil {
+		t.Fatal(err)
+	}
+	for _, feed := range []*Feed{a, b} {
+		if _, err := s.FeedGet(feed.ID); err != db.ErrNotFound {
+			t.Errorf("removed feed %s: FeedGet returned %v, want ErrNotFound", feed.Handle, err)
+		}
+	}
+}
+
+func testStorageDedup(t *testing.T, s Storage) {
+	a := addTestFeed(t, s, "a")
+	b := addTestFeed(t, s, "b")
+	now := time.Now()
+
+	// plain guids are only unique within their feed
+	addTestPosts(t, s, testPost(a.ID, "123", now), testPost(b.ID, "123", now.Add(-time.Second)))
+
+	again := testPost(a.ID, "123", now.Add(-time.Minute))
+	inserted, err := s.PostAddBatch([]*Post{again})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 0 {
+		t.Errorf("post with a known guid was inserted again")
+	}
+
+	// the fingerprint catches items whose guid changed
+	first := testPost(a.ID, "456", now.Add(-2*time.Second))
+	first.Fingerprint = "f00"
+	changed := testPost(a.ID, "789", now.Add(-3*time.Second))
+	changed.Fingerprint = "f00"
+	inserted, err = s.PostAddBatch([]*Post{first, changed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIDs(postIDs(inserted), []int64{first.ID}) {
+		t.Errorf("PostAddBatch inserted %v, want only %d", postIDs(inserted), first.ID)
+	}
+
+	counts, err := s.PostCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[a.ID] != 2 || counts[b.ID] != 1 {
+		t.Errorf("PostCounts returned %v", counts)
+	}
+}
+
+func testStoragePaging(t *testing.T, s Storage) {
+	a := addTestFeed(t, s, "a")
+	b := addTestFeed(t, s, "b")
+	now := time.Now()
+	posts := []*Post{}
+	for i := 0; i < 6; i++ {
+		feed := a.ID
+		if i%2 == 1 {
+			feed = b.ID
+		}
+		posts = append(posts, testPost(feed, string(rune('a'+i)), now.Add(-time.Duration(i)*time.Minute)))
+	}
+	addTestPosts(t, s, posts...)
+
+	var top int64 = 1<<63 - 1
+	page, err := s.PostPage(4, top, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := postIDs(posts[:4])
+	if !sameIDs(postIDs(page), want) {
+		t.Errorf("first page %v, want %v", postIDs(page), want)
+	}
+	page, err = s.PostPage(4, page[len(page)-1].ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = postIDs(posts[4:])
+	if !sameIDs(postIDs(page), want) {
+		t.Errorf("second page %v, want %v", postIDs(page), want)
+	}
+
+	page, err = s.PostPage(10, top, []int64{b.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = postIDs([]*Post{posts[1], posts[3], posts[5]})
+	if !sameIDs(postIDs(page), want) {
+		t.Errorf("page of feed b %v, want %v", postIDs(page), want)
+	}
+	page, err = s.PostPage(10, top, []int64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 {
+		t.Errorf("page of no feeds returned %d posts", len(page))
+	}
+
+	got, err := s.PostGet(posts[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GUID != posts[2].GUID || got.Feed != a.ID {
+		t.Errorf("PostGet returned %+v", got)
+	}
+	if _, err := s.PostGet(MakeID()); err != db.ErrNotFound {
+		t.Errorf("PostGet of a missing post returned %v, want ErrNotFound", err)
+	}
+}
+
+func testStorageTrim(t *testing.T, s Storage) {
+	a := addTestFeed(t, s, "a")
+	now := time.Now()
+	fresh := testPost(a.ID, "fresh", now)
+	stale := testPost(a.ID, "stale", now.Add(-48*time.Hour))
+	saved := testPost(a.ID, "saved", now.Add(-49*time.Hour))
+	addTestPosts(t, s, fresh, stale, saved)
+
+	account := &Account{ID: MakeID(), Name: "reader", Created: now}
+	if err := s.AccountAdd(account); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavedAdd(account.ID, saved.ID); err != nil {
+		t.Fatal(err)
+	}
+	// saving twice is harmless
+	if err := s.SavedAdd(account.ID, saved.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.PostTrim(NewIDGen(1).MakeIDFromTimestamp(now.Add(-24 * time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("PostTrim removed %d posts, want 1", n)
+	}
+	if _, err := s.PostGet(stale.ID); err != db.ErrNotFound {
+		t.Errorf("trimmed post: PostGet returned %v, want ErrNotFound", err)
+	}
+	for _, post := range []*Post{fresh, saved} {
+		if _, err := s.PostGet(post.ID); err != nil {
+			t.Errorf("post %s: PostGet returned %v after trimming", post.GUID, err)
+		}
+	}
+	all, err := s.SavedAll(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIDs(postIDs(all), []int64{saved.ID}) {
+		t.Errorf("SavedAll returned %v, want %d", postIDs(all), saved.ID)
+	}
+	for _, post := range []*Post{fresh, saved} {
+		has, err := s.SavedHas(account.ID, post.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != (post == saved) {
+			t.Errorf("post %s: SavedHas returned %v", post.GUID, has)
+		}
+	}
+
+	// once unsaved, the post is trimmed like any other
+	if err := s.SavedRemove(account.ID, saved.ID); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := s.SavedHas(account.ID, saved.ID); err != nil || has {
+		t.Errorf("removed post: SavedHas returned %v (%v), want false", has, err)
+	}
+	if _, err := s.PostTrim(NewIDGen(1).MakeIDFromTimestamp(now.Add(-24 * time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PostGet(saved.ID); err != db.ErrNotFound {
+		t.Errorf("unsaved post: PostGet returned %v after trimming, want ErrNotFound", err)
+	}
+}
+
+func testStorageContent(t *testing.T, s Storage) {
+	a := addTestFeed(t, s, "a")
+	post := testPost(a.ID, "content", time.Now())
+	addTestPosts(t, s, post)
+
+	fetched := *post
+	if err := s.PostFetchContent(&fetched); err != db.ErrNoContent {
+		t.Fatalf("PostFetchContent before storing returned %v, want ErrNoContent", err)
+	}
+	post.Content = "<p>the article</p>"
+	post.Meta = `{"byline":"someone"}`
+	if err := s.PostStoreContent(post); err != nil {
+		t.Fatal(err)
+	}
+	fetched = Post{ID: post.ID}
+	if err := s.PostFetchContent(&fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Content != post.Content || fetched.Meta != post.Meta {
+		t.Errorf("PostFetchContent returned %q and %q", fetched.Content, fetched.Meta)
+	}
+}
+
+func testStorageRequests(t *testing.T, s Storage) {
+	url := "https://example.com/requested.rss"
+	for i := 0; i < 2; i++ {
+		if err := s.RequestAdd(MakeID(), url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := s.RequestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.Pending() || req.N != 2 {
+		t.Errorf("request after two adds: %+v", req)
+	}
+
+	req.Status = db.RequestRejected
+	req.DecidedBy = "admin"
+	req.DecidedAt = time.Now().UTC().Truncate(time.Second)
+	if err := s.RequestDecide(req); err != nil {
+		t.Fatal(err)
+	}
+	if req, err = s.RequestGet(url); err != nil {
+		t.Fatal(err)
+	}
+	if req.Status != db.RequestRejected || req.DecidedBy != "admin" || req.DecidedAt.IsZero() {
+		t.Errorf("request after rejecting: %+v", req)
+	}
+	if err := s.RequestDecide(req); err != nil {
+		t.Errorf("repeating a decision returned %v", err)
+	}
+	if all, err := s.RequestAll(); err != nil || len(all) != 1 {
+		t.Errorf("RequestAll after repeating a decision returned %v (%v)", all, err)
+	}
+
+	// requesting a rejected feed again reopens the request
+	if err := s.RequestAdd(MakeID(), url); err != nil {
+		t.Fatal(err)
+	}
+	if req, err = s.RequestGet(url); err != nil {
+		t.Fatal(err)
+	}
+	if !req.Pending() || req.N != 1 {
+		t.Errorf("request after reopening: %+v", req)
+	}
+
+	// feeds can be banned before anyone requested them, bans survive
+	// RequestRemoveAll
+	banned := "https://example.com/banned.rss"
+	err = s.RequestDecide(&FeedReq{ID: MakeID(), URL: banned, Date: time.Now(), Status: db.RequestBanned})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestAdd(MakeID(), banned); err != db.ErrBanned {
+		t.Errorf("requesting a banned feed returned %v, want ErrBanned", err)
+	}
+	if err := s.RequestRemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	all, err := s.RequestAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].URL != banned {
+		t.Errorf("RequestAll after RequestRemoveAll returned %v", all)
+	}
+	if err := s.RequestRemove(banned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RequestGet(banned); err != db.ErrNotFound {
+		t.Errorf("removed request: RequestGet returned %v, want ErrNotFound", err)
+	}
+}
+
+func testStorageAccounts(t *testing.T, s Storage) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, name := range []string{"zoe", "adam"} {
+		if err := s.AccountAdd(&Account{ID: MakeID(), Name: name, Hash: "x", Created: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := s.AccountAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Name != "adam" || all[1].Name != "zoe" {
+		t.Fatalf("AccountAll returned %v, want adam and zoe", all)
+	}
+
+	account := all[1]
+	account.Hash = "y"
+	account.Admin = true
+	if err := s.AccountUpdate(account); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.AccountGet("zoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != account.ID || got.Hash != "y" || !got.Admin {
+		t.Errorf("AccountGet returned %+v after update", got)
+	}
+	if err := s.AccountUpdate(account); err != nil {
+		t.Errorf("repeating an update returned %v", err)
+	}
+	if _, err := s.AccountGet("nobody"); err != db.ErrNotFound {
+		t.Errorf("AccountGet of a missing account returned %v, want ErrNotFound", err)
+	}
+}
+
+func testStorageSubscriptions(t *testing.T, s Storage) {
+	a := addTestFeed(t, s, "a")
+	b := addTestFeed(t, s, "b")
+	c := addTestFeed(t, s, "c")
+	account := MakeID()
+
+	subscribed := func() []int64 {
+		feeds, err := s.SubscriptionAll(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(feeds, func(i, j int) bool { return feeds[i] < feeds[j] })
+		return feeds
+	}
+	sorted := func(ids ...int64) []int64 {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+
+	if feeds := subscribed(); len(feeds) != 0 {
+		t.Errorf("new account has subscriptions %v", feeds)
+	}
+	if err := s.SubscriptionSet(account, []int64{a.ID, b.ID, a.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if feeds, want := subscribed(), sorted(a.ID, b.ID); !sameIDs(feeds, want) {
+		t.Errorf("subscriptions %v, want %v", feeds, want)
+	}
+	if err := s.SubscriptionSet(account, []int64{c.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if feeds, want := subscribed(), sorted(c.ID); !sameIDs(feeds, want) {
+		t.Errorf("subscriptions %v after replacing, want %v", feeds, want)
+	}
+	if err := s.SubscriptionSet(account, nil); err != nil {
+		t.Fatal(err)
+	}
+	if feeds := subscribed(); len(feeds) != 0 {
+		t.Errorf("subscriptions %v after clearing", feeds)
+	}
+}
+
+func testStorageReadState(t *testing.T, s Storage) {
+	a := addTestFeed(t, s, "a")
+	b := addTestFeed(t, s, "b")
+	now := time.Now()
+	old := testPost(a.ID, "old", now.Add(-time.Hour))
+	recent := testPost(a.ID, "recent", now)
+	other := testPost(b.ID, "other", now.Add(-time.Minute))
+	addTestPosts(t, s, old, recent, other)
+
+	// anonymous readers have negative ids
+	var reader int64 = -42
+	if err := s.ReadStateMark(reader, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReadStateMarkAll(reader, []int64{a.ID}, old.ID); err != nil {
+		t.Fatal(err)
+	}
+	state, err := s.ReadStateGet(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for post, read := range map[*Post]bool{old: true, recent: false, other: true} {
+		if state.IsRead(post) != read {
+			t.Errorf("post %s: read is %v, want %v", post.GUID, !read, read)
+		}
+	}
+
+	// marks never move backwards
+	if err := s.ReadStateMarkAll(reader, []int64{a.ID}, recent.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReadStateMarkAll(reader, []int64{a.ID}, old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = s.ReadStateGet(reader); err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsRead(recent) {
+		t.Errorf("mark moved backwards")
+	}
+
+	if state, err = s.ReadStateGet(7); err != nil {
+		t.Fatal(err)
+	}
+	if state.IsRead(old) || state.IsRead(other) {
+		t.Errorf("read state leaked to another reader")
+	}
+}
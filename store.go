@@ -1,12 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -14,46 +13,22 @@ import (
 
 	"github.com/boltdb/bolt"
 
-	"github.com/alexander-matz/go-news/readability"
+	"github.com/alexander-matz/go-news/db"
 )
 
-type Feed struct {
-	ID          int64  `json:"id"`
-	Initialized bool   `json:"initialized"`
-	Handle      string `json:"handle"`
-	Title       string `json:"title",omitempty`
-	Link        string `json:"link",omitempty`
-	URL         string `json:"url"`
-	ImageURL    string `json:"imageurl",omitempty`
-}
-
-type Post struct {
-	ID    int64     `json:"id"`
-	Title string    `json:"title"`
-	GUID  string    `json:"guid"`
-	Link  string    `json:"link"`
-	Feed  int64     `json:"feed"`
-	Date  time.Time `json:"-"`
-}
-
-type FeedReq struct {
-	ID   int64     `json:"id"`
-	URL  string    `json:"url"`
-	N    int       `json:"n"`
-	Date time.Time `json:"date"`
-}
-
-type Readability struct {
-	ID      int64
-	URL     string
-	Title   string
-	Content string
-}
+// The data types are shared with the sql backend in package db.
+type (
+	Feed      = db.Feed
+	Post      = db.Post
+	FeedReq   = db.FeedReq
+	Account   = db.Account
+	ReadState = db.ReadState
+)
 
 type feedByHandle []*Feed
 
 func (p feedByHandle) Len() int           { return len(p) }
-func (p feedByHandle) Less(i, j int) bool { return strings.Compare(p[i].Handle, p[j].Handle) > 0 }
+func (p feedByHandle) Less(i, j int) bool { return strings.Compare(p[i].Handle, p[j].Handle) < 0 }
 func (p feedByHandle) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 type postByDate []*Post
@@ -65,18 +40,15 @@ func (p postByDate) Len() int { return len(p) }
 func (p postByDate) Less(i, j int) bool { return p[i].Date.After(p[j].Date) }
 func (p postByDate) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
-type readabilityByDate []*Readability
-
-func (a readabilityByDate) Len() int           { return len(a) }
-func (a readabilityByDate) Less(i, j int) bool { return a[i].ID > a[j].ID }
-func (a readabilityByDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-
 type FeedReqsByCount []*FeedReq
 
 func (a FeedReqsByCount) Len() int           { return len(a) }
 func (a FeedReqsByCount) Less(i, j int) bool { return a[i].N < a[j].N }
 func (a FeedReqsByCount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
+// storeVersion is the version of the bolt database layout this code expects.
+const storeVersion = "0.11"
+
 type Store struct {
 	feeds   []*Feed
 	feedMap map[int64]*Feed
@@ -84,17 +56,12 @@ type Store struct {
 	posts   []*Post
 	postMap map[int64]*Post
 
-	readMap map[string]*Readability
-
 	flock sync.Mutex
 	plock sync.Mutex
-	alock sync.Mutex
 
 	db  *bolt.DB
 	log *log.Logger
 
-	postsHold  time.Duration
-	readHold   int
 	maxFeedReq int
 }
 
@@ -106,13 +73,9 @@ func NewStore(file string, log *log.Logger) (*Store, error) {
 
 	var s Store
 
-	s.readMap = make(map[string]*Readability)
-
 	s.db = db
 	s.log = log
 
-	s.postsHold = time.Hour * 24 * 2
-	s.readHold = 128
 	s.maxFeedReq = 64
 
 	return &s, nil
@@ -124,7 +87,7 @@ func (s *Store) Init() error {
 		if err != nil {
 			return err
 		}
-		err = b.Put([]byte("dbversion"), []byte("0.2"))
+		err = b.Put([]byte("dbversion"), []byte(storeVersion))
 		if err != nil {
 			return err
 		}
@@ -140,6 +103,42 @@ func (s *Store) Init() error {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucket([]byte("guidindex"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("content"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("terms"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("postterms"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("accounts"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("subscriptions"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("readstate"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("saved"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("meta"))
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 	return err
@@ -229,6 +228,192 @@ func (s *Store) UpdateDB() error {
 			return nil
 		})
 	}
+	// changes to 0.3:
+	// bucket guidindex mapping post guids and fingerprints to post ids
+	if s.CheckVersion() == "0.2" {
+		s.log.Printf("updating db 0.2 -> 0.3")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			s.log.Printf("indexing post guids")
+			index, err := tx.CreateBucketIfNotExists([]byte("guidindex"))
+			if err != nil {
+				return err
+			}
+			b := tx.Bucket([]byte("posts"))
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var post Post
+				err := json.Unmarshal(v, &post)
+				if err != nil {
+					s.log.Printf("WARNING: Unable to unmarshal post, skipping")
+					continue
+				}
+				for _, key := range PostKeys(&post) {
+					if err = index.Put([]byte(key), k); err != nil {
+						return err
+					}
+				}
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.3"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.4:
+	// bucket content holding the readability content of posts
+	if s.CheckVersion() == "0.3" {
+		s.log.Printf("updating db 0.3 -> 0.4")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("content")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.4"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.5:
+	// buckets terms and postterms holding the search index
+	if s.CheckVersion() == "0.4" {
+		s.log.Printf("updating db 0.4 -> 0.5")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("terms")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists([]byte("postterms")); err != nil {
+				return err
+			}
+			s.log.Printf("indexing posts")
+			feedTitles := make(map[int64]string)
+			c := tx.Bucket([]byte("feeds")).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var feed Feed
+				if err := json.Unmarshal(v, &feed); err == nil {
+					feedTitles[feed.ID] = feed.Title
+				}
+			}
+			content := tx.Bucket([]byte("content"))
+			c = tx.Bucket([]byte("posts")).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var post Post
+				if err := json.Unmarshal(v, &post); err != nil {
+					s.log.Printf("WARNING: Unable to unmarshal post, skipping")
+					continue
+				}
+				terms := db.Terms(post.Title, feedTitles[post.Feed], string(content.Get(k)))
+				if err := indexPost(tx, k, terms); err != nil {
+					return err
+				}
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.5"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.6:
+	// bucket accounts
+	if s.CheckVersion() == "0.5" {
+		s.log.Printf("updating db 0.5 -> 0.6")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("accounts")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.6"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.7:
+	// bucket subscriptions
+	if s.CheckVersion() == "0.6" {
+		s.log.Printf("updating db 0.6 -> 0.7")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("subscriptions")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.7"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.8:
+	// bucket readstate
+	if s.CheckVersion() == "0.7" {
+		s.log.Printf("updating db 0.7 -> 0.8")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("readstate")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.8"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.9:
+	// bucket saved
+	if s.CheckVersion() == "0.8" {
+		s.log.Printf("updating db 0.8 -> 0.9")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("saved")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.9"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.10:
+	// bucket meta
+	if s.CheckVersion() == "0.9" {
+		s.log.Printf("updating db 0.9 -> 0.10")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("meta")); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.10"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// changes to 0.11:
+	// guids in bucket guidindex are scoped by feed
+	if s.CheckVersion() == "0.10" {
+		s.log.Printf("updating db 0.10 -> 0.11")
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			s.log.Printf("reindexing post guids")
+			if err := tx.DeleteBucket([]byte("guidindex")); err != nil {
+				return err
+			}
+			index, err := tx.CreateBucket([]byte("guidindex"))
+			if err != nil {
+				return err
+			}
+			c := tx.Bucket([]byte("posts")).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var post Post
+				if err := json.Unmarshal(v, &post); err != nil {
+					s.log.Printf("WARNING: Unable to unmarshal post, skipping")
+					continue
+				}
+				for _, key := range PostKeys(&post) {
+					if err = index.Put([]byte(key), k); err != nil {
+						return err
+					}
+				}
+			}
+			return tx.Bucket([]byte("info")).Put([]byte("dbversion"), []byte("0.11"))
+		})
+		if err != nil {
+			return err
+		}
+	}
 	s.log.Printf("db on newest version")
 	return nil
 }
@@ -252,21 +437,17 @@ func (s *Store) Dump() {
 				feed = Feed{}
 				feed.ID = -1
 			}
-			s.log.Printf("  %d = %s", id, feed)
+			s.log.Printf("  %d = %v", id, feed)
 		}
 		return nil
 	})
 }
 
-func (s *Store) Close() {
+func (s *Store) Disconnect() {
 	s.db.Close()
 	return
 }
 
-func (s *Store) PostsMaxAge() time.Time {
-	return time.Now().Add(s.postsHold * -1)
-}
-
 func (s *Store) CheckVersion() string {
 	version := "?"
 	s.db.View(func(tx *bolt.Tx) error {
@@ -320,10 +501,9 @@ func (s *Store) feedsCacheInvalidate() {
 	s.feedMap = nil
 }
 
-func (s *Store) FeedsSet(f *Feed) error {
-	if f.ID <= 0 {
-		return errors.New("invalid feed id")
-	}
+// feedsPut validates f and writes it to the database. The caller must hold
+// flock.
+func (s *Store) feedsPut(f *Feed) error {
 	if f.URL == "" {
 		return errors.New("invalid feed url")
 	}
@@ -331,10 +511,6 @@ func (s *Store) FeedsSet(f *Feed) error {
 		return errors.New("invalid feed handle")
 	}
 
-	s.flock.Lock()
-	defer s.flock.Unlock()
-	s.feedsCacheTouch()
-
 	for _, feed := range s.feeds {
 		if feed.ID == f.ID {
 			continue
@@ -347,7 +523,6 @@ func (s *Store) FeedsSet(f *Feed) error {
 		}
 	}
 
-	// add feeds to database
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("feeds"))
 		v, err := json.Marshal(f)
@@ -356,8 +531,7 @@ func (s *Store) FeedsSet(f *Feed) error {
 		}
 		var k [8]byte
 		binary.BigEndian.PutUint64(k[:], uint64(f.ID))
-		b.Put(k[:], v)
-		return nil
+		return b.Put(k[:], v)
 	})
 	if err != nil {
 		return err
@@ -367,36 +541,149 @@ func (s *Store) FeedsSet(f *Feed) error {
 	return nil
 }
 
-func (s *Store) FeedsExists(f *Feed) bool {
+// FeedAdd inserts a new feed. The caller is responsible for choosing a
+// unique id.
+func (s *Store) FeedAdd(f *Feed) (int64, error) {
+	if f.ID <= 0 {
+		return -1, errors.New("invalid feed id")
+	}
+
+	s.flock.Lock()
+	defer s.flock.Unlock()
+	s.feedsCacheTouch()
+
+	if _, ok := s.feedMap[f.ID]; ok {
+		return -1, errors.New("feed id already exists")
+	}
+	if err := s.feedsUnique(f); err != nil {
+		return -1, err
+	}
+	if err := s.feedsPut(f); err != nil {
+		return -1, err
+	}
+	return f.ID, nil
+}
+
+func (s *Store) FeedUpdate(f *Feed) error {
+	s.flock.Lock()
+	defer s.flock.Unlock()
+	s.feedsCacheTouch()
+
+	if _, ok := s.feedMap[f.ID]; !ok {
+		return db.ErrNotFound
+	}
+	if err := s.feedsUnique(f); err != nil {
+		return err
+	}
+	return s.feedsPut(f)
+}
+
+// feedsUnique checks that no other feed has the handle or url of f, like the
+// unique columns of the sql backend.
+func (s *Store) feedsUnique(f *Feed) error {
+	for _, other := range s.feeds {
+		if other.ID != f.ID && (other.Handle == f.Handle || other.URL == f.URL) {
+			return errors.New("feed handle or url already exists")
+		}
+	}
+	return nil
+}
+
+// FeedRemoveByHandleOrURL removes a feed together with its posts, their
+// content, their index entries, the subscriptions to the feed and its read
+// state. Saved posts of the feed are removed as well. It returns the number
+// of removed posts.
+func (s *Store) FeedRemoveByHandleOrURL(handleOrURL string) (int64, error) {
 	s.flock.Lock()
 	defer s.flock.Unlock()
 	s.feedsCacheTouch()
 
+	var id int64 = -1
 	for _, feed := range s.feeds {
-		if feed.URL == f.URL {
-			return true
+		if feed.Handle == handleOrURL || feed.URL == handleOrURL {
+			id = feed.ID
 		}
-		if feed.Handle == f.Handle {
-			return true
+	}
+	if id == -1 {
+		return 0, errors.New("no feed with that handle or url")
+	}
+
+	var n int64 = 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// collect first, deleting while iterating skips elements
+		b := tx.Bucket([]byte("posts"))
+		posts := make(map[string]*Post)
+		err := b.ForEach(func(k, v []byte) error {
+			var post Post
+			if err := json.Unmarshal(v, &post); err != nil {
+				s.log.Printf("WARNING: Unable to unmarshal post, skipping")
+				return nil
+			}
+			if post.Feed == id {
+				posts[string(k)] = &post
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		removed := make(map[int64]bool)
+		for k, post := range posts {
+			if err = removePost(tx, []byte(k), post); err != nil {
+				return err
+			}
+			removed[post.ID] = true
+			n += 1
+		}
+		if err = unsavePosts(tx, removed); err != nil {
+			return err
 		}
+
+		if err = unsubscribeFeed(tx, id); err != nil {
+			return err
+		}
+		if err = forgetReadState(tx, id, 0); err != nil {
+			return err
+		}
+
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], uint64(id))
+		return tx.Bucket([]byte("feeds")).Delete(k[:])
+	})
+	if err != nil {
+		return 0, err
 	}
-	return false
+
+	s.feedsCacheInvalidate()
+	s.postCacheInvalidate()
+	return n, nil
 }
 
-func (s *Store) FeedsAll() []*Feed {
+func (s *Store) FeedGet(id int64) (*Feed, error) {
 	s.flock.Lock()
 	defer s.flock.Unlock()
 	s.feedsCacheTouch()
 
-	return s.feeds
+	feed, ok := s.feedMap[id]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	res := *feed
+	return &res, nil
 }
 
-func (s *Store) FeedsAllMap() map[int64]*Feed {
+func (s *Store) FeedAll() ([]*Feed, error) {
 	s.flock.Lock()
 	defer s.flock.Unlock()
 	s.feedsCacheTouch()
 
-	return s.feedMap
+	// hand out copies, the cache is shared
+	res := make([]*Feed, len(s.feeds))
+	for i, feed := range s.feeds {
+		f := *feed
+		res[i] = &f
+	}
+	return res, nil
 }
 
 /******************************************************************************
@@ -438,17 +725,26 @@ func (s *Store) postCacheGet() ([]*Post, map[int64]*Post) {
 	return posts, postMap
 }
 
-func (s *Store) PostsInsert(posts []*Post) error {
+// PostAddBatch stores all posts that are not already known by one of their
+// keys and returns the posts actually stored.
+func (s *Store) PostAddBatch(posts []*Post) ([]*Post, error) {
+	inserted := make([]*Post, 0)
 	if len(posts) == 0 {
-		return nil
+		return inserted, nil
 	}
 
-	maxAge := s.PostsMaxAge()
+	feedTitles := s.feedTitles()
 
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("posts"))
+		index := tx.Bucket([]byte("guidindex"))
 		for _, p := range posts {
-			if p.Date.Before(maxAge) {
+			keys := PostKeys(p)
+			known := false
+			for _, key := range keys {
+				known = known || index.Get([]byte(key)) != nil
+			}
+			if known {
 				continue
 			}
 			v, err := json.Marshal(p)
@@ -457,168 +753,430 @@ func (s *Store) PostsInsert(posts []*Post) error {
 			}
 			var k [8]byte
 			binary.BigEndian.PutUint64(k[:], uint64(p.ID))
-			b.Put(k[:], v)
+			if err = b.Put(k[:], v); err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err = index.Put([]byte(key), k[:]); err != nil {
+					return err
+				}
+			}
+			if err = indexPost(tx, k[:], db.Terms(p.Title, feedTitles[p.Feed])); err != nil {
+				return err
+			}
+			inserted = append(inserted, p)
 		}
 		return nil
 	})
 	if err != nil {
 		s.log.Printf("ERROR: %s", err.Error())
+		inserted = inserted[:0]
 	}
 	s.postCacheInvalidate()
 
-	return err
+	return inserted, err
 }
 
-func (s *Store) PostsGUIDMap() (map[string]bool, error) {
-	guids := make(map[string]bool)
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("posts"))
-		c := b.Cursor()
-		for k, v := c.Last(); k != nil; k, v = c.Prev() {
-			var post Post
-			err := json.Unmarshal(v, &post)
-			if err != nil {
-				return err
-			}
-			guids[post.GUID] = true
-		}
-		return nil
-	})
-	return guids, err
+func (s *Store) PostGet(id int64) (*Post, error) {
+	_, m := s.postCacheGet()
+
+	p, ok := m[id]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	res := *p
+	return &res, nil
 }
 
-func (s *Store) PostsFilter(n int, filter func(*Post) bool) []*Post {
+// PostPage returns the n newest posts with an id below before. If feeds is
+// not nil, only posts of these feeds are returned.
+func (s *Store) PostPage(n int, before int64, feeds []int64) ([]*Post, error) {
 	posts, _ := s.postCacheGet()
 
-	res := make([]*Post, 0)
-	i := 0
-	if n < 0 {
-		n = len(posts)
+	var lookup map[int64]bool
+	if feeds != nil {
+		lookup = make(map[int64]bool)
+		for _, id := range feeds {
+			lookup[id] = true
+		}
 	}
-	for n > 0 && i < len(posts) {
-		if filter(posts[i]) {
-			res = append(res, posts[i])
-			n -= 1
+
+	res := make([]*Post, 0)
+	for i := 0; len(res) < n && i < len(posts); i += 1 {
+		if posts[i].ID >= before {
+			continue
+		}
+		if lookup != nil && !lookup[posts[i].Feed] {
+			continue
 		}
-		i += 1
+		p := *posts[i]
+		res = append(res, &p)
 	}
-	return res
+	return res, nil
 }
 
-func (s *Store) PostsGet(id int64) *Post {
-	_, m := s.postCacheGet()
-
-	p, ok := m[id]
-	if !ok {
-		return nil
+// PostCounts returns the number of stored posts per feed id.
+func (s *Store) PostCounts() (map[int64]int64, error) {
+	posts, _ := s.postCacheGet()
+	counts := make(map[int64]int64)
+	for _, post := range posts {
+		counts[post.Feed] += 1
 	}
-	return &(*p)
+	return counts, nil
 }
 
-func (s *Store) PostsTrim() {
-	n := 0
-	_ = s.db.Update(func(tx *bolt.Tx) error {
-		t := MakeIDRaw(s.PostsMaxAge(), 0, 0)
+// PostTrim removes all posts with an id below before, together with their
+// content, except for saved ones. It returns the number of posts removed.
+func (s *Store) PostTrim(before int64) (int64, error) {
+	var n int64 = 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		saved := savedPosts(tx)
 		b := tx.Bucket([]byte("posts"))
 		c := b.Cursor()
 		var start [8]byte
-		binary.BigEndian.PutUint64(start[:], uint64(t))
+		binary.BigEndian.PutUint64(start[:], uint64(before))
 		// Seek here, than do Prev right after to skip first value
 		c.Seek(start[:])
 		for k, v := c.Prev(); k != nil; k, v = c.Prev() {
-			err := b.Delete(k)
+			if saved[int64(binary.BigEndian.Uint64(k))] {
+				continue
+			}
+			var post Post
+			err := json.Unmarshal(v, &post)
 			if err != nil {
 				s.log.Printf("WARNING: UNABLE TO TRIM DATABASE ELEMENT")
 				continue
 			}
-			var post Post
-			err = json.Unmarshal(v, &post)
+			err = b.Delete(k)
 			if err != nil {
 				s.log.Printf("WARNING: UNABLE TO TRIM DATABASE ELEMENT")
 				continue
 			}
+			if err = removePostData(tx, k, &post); err != nil {
+				return err
+			}
 			n += 1
 		}
-		return nil
+		return forgetReadState(tx, 0, before)
 	})
-	s.log.Printf("trimmed %d posts", n)
 
 	s.postCacheInvalidate()
+	return n, err
+}
+
+// removePost deletes the post stored under k along with everything that
+// refers to it.
+func removePost(tx *bolt.Tx, k []byte, post *Post) error {
+	if err := tx.Bucket([]byte("posts")).Delete(k); err != nil {
+		return err
+	}
+	return removePostData(tx, k, post)
+}
+
+// removePostData deletes the guid index entries, content and search terms of
+// the post stored under k.
+func removePostData(tx *bolt.Tx, k []byte, post *Post) error {
+	index := tx.Bucket([]byte("guidindex"))
+	// keys may have been taken over by a newer post in the meantime
+	for _, key := range PostKeys(post) {
+		if bytes.Equal(index.Get([]byte(key)), k) {
+			if err := index.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Bucket([]byte("content")).Delete(k); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte("meta")).Delete(k); err != nil {
+		return err
+	}
+	return unindexPost(tx, k)
+}
+
+// PostsEach calls fn with batches of at most n posts with an id above after,
+// oldest first. The posts carry their content if it was stored. Iteration
+// stops at the first error returned by fn.
+func (s *Store) PostsEach(after int64, n int, fn func([]*Post) error) error {
+	for {
+		batch := make([]*Post, 0, n)
+		seen := 0
+		err := s.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("posts"))
+			content := tx.Bucket([]byte("content"))
+			meta := tx.Bucket([]byte("meta"))
+			c := b.Cursor()
+			var start [8]byte
+			binary.BigEndian.PutUint64(start[:], uint64(after+1))
+			for k, v := c.Seek(start[:]); k != nil && seen < n; k, v = c.Next() {
+				seen += 1
+				after = int64(binary.BigEndian.Uint64(k))
+				var post Post
+				if err := json.Unmarshal(v, &post); err != nil {
+					s.log.Printf("WARNING: Unable to unmarshal post, skipping")
+					continue
+				}
+				post.Date = TimeFromID(post.ID)
+				if v := content.Get(k); v != nil {
+					post.Content = string(v)
+					post.Meta = string(meta.Get(k))
+				}
+				batch = append(batch, &post)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if seen == 0 {
+			return nil
+		}
+		if err = fn(batch); err != nil {
+			return err
+		}
+	}
 }
 
 /******************************************************************************
- * READABILITY
+ * CONTENT
  *****************************************************************************/
 
-func (s *Store) readabilityTrim() {
-	s.alock.Lock()
-	defer s.alock.Unlock()
+// PostFetchContent loads the extracted article content of a post into
+// post.Content. It returns db.ErrNoContent if it has not been stored yet.
+func (s *Store) PostFetchContent(post *Post) error {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], uint64(post.ID))
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("posts")).Get(k[:]) == nil {
+			return db.ErrNotFound
+		}
+		v := tx.Bucket([]byte("content")).Get(k[:])
+		if v == nil {
+			return db.ErrNoContent
+		}
+		post.Content = string(v)
+		post.Meta = string(tx.Bucket([]byte("meta")).Get(k[:]))
+		return nil
+	})
+}
+
+// PostStoreContent stores post.Content as the extracted article content and
+// post.Meta as its metadata.
+func (s *Store) PostStoreContent(post *Post) error {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], uint64(post.ID))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("posts")).Get(k[:]) == nil {
+			return db.ErrNotFound
+		}
+		err := tx.Bucket([]byte("content")).Put(k[:], []byte(post.Content))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("meta")).Put(k[:], []byte(post.Meta))
+		if err != nil {
+			return err
+		}
+		return indexPost(tx, k[:], db.Terms(post.Content))
+	})
+}
 
-	n := s.readHold
+/******************************************************************************
+ * SEARCH
+ * The terms bucket has a key <term>\x00<post id> for every term of a post,
+ * the postterms bucket remembers the terms of every post so they can be
+ * removed with it.
+ */
+
+func termKey(term string, k []byte) []byte {
+	key := make([]byte, 0, len(term)+1+len(k))
+	key = append(key, term...)
+	key = append(key, 0)
+	return append(key, k...)
+}
 
-	if len(s.readMap) < n {
-		return
+// indexPost adds terms to the index of the post with key k.
+func indexPost(tx *bolt.Tx, k []byte, terms []string) error {
+	postterms := tx.Bucket([]byte("postterms"))
+	known := make([]string, 0)
+	if v := postterms.Get(k); v != nil {
+		if err := json.Unmarshal(v, &known); err != nil {
+			return err
+		}
 	}
-
-	list := make([]*Readability, len(s.readMap))
-	i := 0
-	for _, r := range s.readMap {
-		list[i] = r
-		i += 1
+	skip := make(map[string]bool)
+	for _, term := range known {
+		skip[term] = true
 	}
-	sort.Sort(readabilityByDate(list))
-	for i = n; i < len(list); i += 1 {
-		delete(s.readMap, list[i].URL)
+	b := tx.Bucket([]byte("terms"))
+	for _, term := range terms {
+		if skip[term] {
+			continue
+		}
+		if err := b.Put(termKey(term, k), []byte{}); err != nil {
+			return err
+		}
+		known = append(known, term)
+	}
+	v, err := json.Marshal(known)
+	if err != nil {
+		return err
 	}
+	return postterms.Put(k, v)
 }
 
-func (s *Store) fetchReadability(url string) (*Readability, error) {
-	res, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// unindexPost removes the post with key k from the index.
+func unindexPost(tx *bolt.Tx, k []byte) error {
+	postterms := tx.Bucket([]byte("postterms"))
+	v := postterms.Get(k)
+	if v == nil {
+		return nil
 	}
-	defer res.Body.Close()
-	html, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	var terms []string
+	if err := json.Unmarshal(v, &terms); err != nil {
+		return err
 	}
-	doc, err := readability.NewDocument(string(html))
-	if err != nil {
-		return nil, err
+	b := tx.Bucket([]byte("terms"))
+	for _, term := range terms {
+		if err := b.Delete(termKey(term, k)); err != nil {
+			return err
+		}
 	}
-	r := &Readability{MakeID(), url, "", doc.Content()}
-	s.readMap[url] = r
-	s.readabilityTrim()
+	return postterms.Delete(k)
+}
+
+// feedTitles returns the titles of all feeds by id.
+func (s *Store) feedTitles() map[int64]string {
+	s.flock.Lock()
+	defer s.flock.Unlock()
+	s.feedsCacheTouch()
 
-	return r, nil
+	titles := make(map[int64]string)
+	for _, feed := range s.feeds {
+		titles[feed.ID] = feed.Title
+	}
+	return titles
 }
 
-func (s *Store) ReadabilityGetOne(id int64) (*Readability, error) {
-	p := s.PostsGet(id)
-	if p == nil {
-		return nil, errors.New("invalid article id")
+// PostSearch returns the n newest posts with an id below before that match
+// the query. Candidates come from the index of the first term, the others
+// are looked up for each of them.
+func (s *Store) PostSearch(q *db.Query, n int, before int64) ([]*Post, error) {
+	s.flock.Lock()
+	s.feedsCacheTouch()
+	feeds := make(map[int64]*Feed)
+	for _, feed := range s.feeds {
+		feeds[feed.ID] = feed
+	}
+	var lookup map[int64]bool
+	if len(q.Feeds) > 0 {
+		lookup = make(map[int64]bool)
+		for _, handle := range q.Feeds {
+			for _, feed := range s.feeds {
+				if feed.Handle == handle {
+					lookup[feed.ID] = true
+				}
+			}
+		}
 	}
+	s.flock.Unlock()
 
-	s.alock.Lock()
-	r, ok := s.readMap[p.Link]
-	s.alock.Unlock()
+	res := make([]*Post, 0)
+	_, postMap := s.postCacheGet()
 
-	if ok {
-		return &(*r), nil
+	// match returns false once no older post can match
+	match := func(tx *bolt.Tx, post *Post) (bool, bool) {
+		if !q.After.IsZero() && post.Date.Before(q.After) {
+			return false, false
+		}
+		if !q.MatchDate(post.Date) || (lookup != nil && !lookup[post.Feed]) {
+			return false, true
+		}
+		if len(q.Phrases) > 0 {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], uint64(post.ID))
+			title := ""
+			if feed, ok := feeds[post.Feed]; ok {
+				title = feed.Title
+			}
+			content := string(tx.Bucket([]byte("content")).Get(k[:]))
+			if !q.MatchPhrases(post.Title, title, content) {
+				return false, true
+			}
+		}
+		return true, true
 	}
-	r, err := s.fetchReadability(p.Link)
-	if err != nil {
-		return nil, err
+
+	if len(q.Terms) == 0 {
+		posts, _ := s.postCacheGet()
+		err := s.db.View(func(tx *bolt.Tx) error {
+			for i := 0; len(res) < n && i < len(posts); i += 1 {
+				if posts[i].ID >= before {
+					continue
+				}
+				ok, more := match(tx, posts[i])
+				if !more {
+					break
+				}
+				if ok {
+					p := *posts[i]
+					res = append(res, &p)
+				}
+			}
+			return nil
+		})
+		return res, err
 	}
 
-	return r, nil
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("terms"))
+		prefix := termKey(q.Terms[0], nil)
+		var start [8]byte
+		binary.BigEndian.PutUint64(start[:], uint64(before))
+		c := b.Cursor()
+		// seek to the first id not below before, then walk backwards
+		k, _ := c.Seek(termKey(q.Terms[0], start[:]))
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(res) < n; k, _ = c.Prev() {
+			id := k[len(prefix):]
+			all := true
+			for _, term := range q.Terms[1:] {
+				all = all && b.Get(termKey(term, id)) != nil
+			}
+			if !all {
+				continue
+			}
+			post, ok := postMap[int64(binary.BigEndian.Uint64(id))]
+			if !ok {
+				continue
+			}
+			ok, more := match(tx, post)
+			if !more {
+				break
+			}
+			if ok {
+				p := *post
+				res = append(res, &p)
+			}
+		}
+		return nil
+	})
+	return res, err
 }
 
 /******************************************************************************
  * FEED REQUESTS
  *****************************************************************************/
 
-func (s *Store) FeedReqsAdd(url string) error {
+// RequestAdd records a request for the feed at url, or counts another
+// request if it was requested before. Requesting a rejected or approved feed
+// again reopens the request, banned feeds return db.ErrBanned. New requests
+// beyond the limit of pending ones return db.ErrRequestLimit.
+func (s *Store) RequestAdd(id int64, url string) error {
 	if url == "" {
 		return errors.New("invalid feed request url")
 	}
@@ -635,8 +1193,14 @@ func (s *Store) FeedReqsAdd(url string) error {
 			if err != nil {
 				return errors.New("unable to encode json")
 			}
-			// update fields
-			req.N += 1
+			switch req.Status {
+			case db.RequestBanned:
+				return db.ErrBanned
+			case db.RequestPending:
+				req.N += 1
+			default:
+				req = FeedReq{ID: req.ID, URL: req.URL, N: 1}
+			}
 			req.Date = time.Now()
 
 			encoded, err = json.Marshal(req)
@@ -645,11 +1209,19 @@ func (s *Store) FeedReqsAdd(url string) error {
 			}
 		} else {
 			// case 2: request does not exist
-			if b.Stats().KeyN > s.maxFeedReq {
-				return errors.New("maximum number of feed request reached")
+			pending := 0
+			b.ForEach(func(k, v []byte) error {
+				var req FeedReq
+				if json.Unmarshal(v, &req) == nil && req.Pending() {
+					pending += 1
+				}
+				return nil
+			})
+			if pending >= s.maxFeedReq {
+				return db.ErrRequestLimit
 			}
 			var req FeedReq
-			req.ID = MakeID()
+			req.ID = id
 			req.URL = url
 			req.Date = time.Now()
 			req.N = 1
@@ -658,13 +1230,51 @@ func (s *Store) FeedReqsAdd(url string) error {
 				return errors.New("unable to encode json")
 			}
 		}
-		b.Put([]byte(url), encoded)
-		return nil
+		return b.Put([]byte(url), encoded)
 	})
 	return err
 }
 
-func (s *Store) FeedReqsAll() ([]*FeedReq, error) {
+// RequestDecide records the decision stored in req for the request of
+// req.URL. Requests that do not exist yet are created, so feeds can be
+// banned before anyone asked for them.
+func (s *Store) RequestDecide(req *FeedReq) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("feedrequests"))
+		stored := *req
+		if encoded := b.Get([]byte(req.URL)); encoded != nil {
+			if err := json.Unmarshal(encoded, &stored); err != nil {
+				return errors.New("unable to decode json")
+			}
+			stored.Status = req.Status
+			stored.DecidedBy = req.DecidedBy
+			stored.DecidedAt = req.DecidedAt
+			stored.Handle = req.Handle
+		}
+		encoded, err := json.Marshal(stored)
+		if err != nil {
+			return errors.New("unable to encode json")
+		}
+		return b.Put([]byte(req.URL), encoded)
+	})
+}
+
+func (s *Store) RequestGet(url string) (*FeedReq, error) {
+	var req FeedReq
+	err := s.db.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket([]byte("feedrequests")).Get([]byte(url))
+		if encoded == nil {
+			return db.ErrNotFound
+		}
+		return json.Unmarshal(encoded, &req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *Store) RequestAll() ([]*FeedReq, error) {
 	res := make([]*FeedReq, 0)
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("feedrequests"))
@@ -679,26 +1289,417 @@ func (s *Store) FeedReqsAll() ([]*FeedReq, error) {
 		}
 		return nil
 	})
+	sort.Stable(sort.Reverse(FeedReqsByCount(res)))
 
 	return res, err
 }
 
-func (s *Store) FeedReqsRemove(fs []*FeedReq) error {
+func (s *Store) RequestRemove(url string) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("feedrequests"))
-		for _, f := range fs {
-			b.Delete([]byte(f.URL))
+		if b.Get([]byte(url)) == nil {
+			return db.ErrNotFound
 		}
-		return nil
+		return b.Delete([]byte(url))
 	})
 	return err
 }
 
-func (s *Store) FeedReqsRemoveAll() error {
+// RequestRemoveAll removes all requests except bans.
+func (s *Store) RequestRemoveAll() error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("feedrequests"))
-		tx.CreateBucketIfNotExists([]byte("feedrequests"))
+		b := tx.Bucket([]byte("feedrequests"))
+		remove := make([][]byte, 0)
+		b.ForEach(func(k, v []byte) error {
+			var req FeedReq
+			if json.Unmarshal(v, &req) != nil || req.Status != db.RequestBanned {
+				remove = append(remove, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	return err
 }
+
+/******************************************************************************
+ * ACCOUNTS
+ * Stored by name.
+ *****************************************************************************/
+
+func (s *Store) AccountAdd(account *Account) error {
+	if account.ID <= 0 || account.Name == "" {
+		return errors.New("invalid account")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("accounts"))
+		if b.Get([]byte(account.Name)) != nil {
+			return errors.New("account exists")
+		}
+		encoded, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(account.Name), encoded)
+	})
+}
+
+func (s *Store) AccountUpdate(account *Account) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("accounts"))
+		// the name may have changed, find the account by id
+		var old []byte
+		b.ForEach(func(k, v []byte) error {
+			var stored Account
+			if json.Unmarshal(v, &stored) == nil && stored.ID == account.ID {
+				old = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if old == nil {
+			return db.ErrNotFound
+		}
+		if string(old) != account.Name {
+			if b.Get([]byte(account.Name)) != nil {
+				return errors.New("account exists")
+			}
+			if err := b.Delete(old); err != nil {
+				return err
+			}
+		}
+		encoded, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(account.Name), encoded)
+	})
+}
+
+func (s *Store) AccountGet(name string) (*Account, error) {
+	var account Account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket([]byte("accounts")).Get([]byte(name))
+		if encoded == nil {
+			return db.ErrNotFound
+		}
+		return json.Unmarshal(encoded, &account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// AccountAll returns all accounts ordered by name.
+func (s *Store) AccountAll() ([]*Account, error) {
+	res := make([]*Account, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("accounts")).ForEach(func(k, v []byte) error {
+			var account Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return nil
+			}
+			res = append(res, &account)
+			return nil
+		})
+	})
+	return res, err
+}
+
+/******************************************************************************
+ * SUBSCRIPTIONS
+ * A key <account id><feed id> for every subscription.
+ *****************************************************************************/
+
+// accountKey is the key of id in the buckets keyed by account.
+func accountKey(account, id int64) []byte {
+	var k [16]byte
+	binary.BigEndian.PutUint64(k[:8], uint64(account))
+	binary.BigEndian.PutUint64(k[8:], uint64(id))
+	return k[:]
+}
+
+// SubscriptionAll returns the ids of the feeds account is subscribed to.
+func (s *Store) SubscriptionAll(account int64) ([]int64, error) {
+	res := make([]int64, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("subscriptions")).Cursor()
+		prefix := accountKey(account, 0)[:8]
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			res = append(res, int64(binary.BigEndian.Uint64(k[8:])))
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SubscriptionSet replaces the subscriptions of account by feeds.
+func (s *Store) SubscriptionSet(account int64, feeds []int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("subscriptions"))
+		prefix := accountKey(account, 0)[:8]
+		remove := make([][]byte, 0)
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			remove = append(remove, append([]byte{}, k...))
+		}
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, feed := range feeds {
+			if err := b.Put(accountKey(account, feed), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unsubscribeFeed removes all subscriptions to feed.
+func unsubscribeFeed(tx *bolt.Tx, feed int64) error {
+	b := tx.Bucket([]byte("subscriptions"))
+	remove := make([][]byte, 0)
+	b.ForEach(func(k, v []byte) error {
+		if int64(binary.BigEndian.Uint64(k[8:])) == feed {
+			remove = append(remove, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, k := range remove {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/******************************************************************************
+ * READ STATE
+ * Per reader, a key <reader id>m<feed id> holding the mark of the feed and a
+ * key <reader id>p<post id> holding the feed id for every post read above
+ * the mark.
+ *****************************************************************************/
+
+func readStateKey(reader int64, kind byte, id int64) []byte {
+	var k [17]byte
+	binary.BigEndian.PutUint64(k[:8], uint64(reader))
+	k[8] = kind
+	binary.BigEndian.PutUint64(k[9:], uint64(id))
+	return k[:]
+}
+
+func int64Bytes(n int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	return b[:]
+}
+
+// ReadStateGet returns what reader has read.
+func (s *Store) ReadStateGet(reader int64) (*ReadState, error) {
+	state := db.NewReadState()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("readstate")).Cursor()
+		prefix := int64Bytes(reader)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			id := int64(binary.BigEndian.Uint64(k[9:]))
+			switch k[8] {
+			case 'm':
+				state.Marks[id] = int64(binary.BigEndian.Uint64(v))
+			case 'p':
+				state.Read[id] = true
+			}
+		}
+		return nil
+	})
+	return state, err
+}
+
+// ReadStateEach calls fn with the marks of every reader and the posts read
+// above them, which only carry their id and feed. Iteration stops at the
+// first error returned by fn.
+func (s *Store) ReadStateEach(fn func(reader int64, marks map[int64]int64, read []*Post) error) error {
+	readers := []int64{}
+	marks := make(map[int64]map[int64]int64)
+	read := make(map[int64][]*Post)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("readstate")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			reader := int64(binary.BigEndian.Uint64(k[:8]))
+			id := int64(binary.BigEndian.Uint64(k[9:]))
+			if _, ok := marks[reader]; !ok {
+				readers = append(readers, reader)
+				marks[reader] = make(map[int64]int64)
+			}
+			switch k[8] {
+			case 'm':
+				marks[reader][id] = int64(binary.BigEndian.Uint64(v))
+			case 'p':
+				read[reader] = append(read[reader], &Post{ID: id, Feed: int64(binary.BigEndian.Uint64(v))})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, reader := range readers {
+		if err := fn(reader, marks[reader], read[reader]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadStateMark marks post as read by reader.
+func (s *Store) ReadStateMark(reader int64, post *Post) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("readstate"))
+		if v := b.Get(readStateKey(reader, 'm', post.Feed)); v != nil &&
+			int64(binary.BigEndian.Uint64(v)) >= post.ID {
+			return nil
+		}
+		return b.Put(readStateKey(reader, 'p', post.ID), int64Bytes(post.Feed))
+	})
+}
+
+// ReadStateMarkAll marks all posts of feeds with an id up to until as read by
+// reader.
+func (s *Store) ReadStateMarkAll(reader int64, feeds []int64, until int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("readstate"))
+		marks := make(map[int64]int64)
+		for _, feed := range feeds {
+			k := readStateKey(reader, 'm', feed)
+			mark := until
+			if v := b.Get(k); v != nil && int64(binary.BigEndian.Uint64(v)) > mark {
+				mark = int64(binary.BigEndian.Uint64(v))
+			}
+			if err := b.Put(k, int64Bytes(mark)); err != nil {
+				return err
+			}
+			marks[feed] = mark
+		}
+
+		remove := make([][]byte, 0)
+		c := b.Cursor()
+		prefix := readStateKey(reader, 'p', 0)[:9]
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			mark, ok := marks[int64(binary.BigEndian.Uint64(v))]
+			if ok && int64(binary.BigEndian.Uint64(k[9:])) <= mark {
+				remove = append(remove, append([]byte{}, k...))
+			}
+		}
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forgetReadState removes the marks and read posts of feed and the read posts
+// with an id below before, for all readers.
+func forgetReadState(tx *bolt.Tx, feed, before int64) error {
+	b := tx.Bucket([]byte("readstate"))
+	remove := make([][]byte, 0)
+	b.ForEach(func(k, v []byte) error {
+		id := int64(binary.BigEndian.Uint64(k[9:]))
+		switch {
+		case k[8] == 'm' && id == feed,
+			k[8] == 'p' && (id < before || int64(binary.BigEndian.Uint64(v)) == feed):
+			remove = append(remove, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, k := range remove {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/******************************************************************************
+ * SAVED POSTS
+ * A key <account id><post id> for every saved post.
+ *****************************************************************************/
+
+// SavedAdd saves post for account.
+func (s *Store) SavedAdd(account, post int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("saved")).Put(accountKey(account, post), []byte{})
+	})
+}
+
+// SavedRemove removes post from the saved posts of account. The post is
+// trimmed as usual once nobody has it saved.
+func (s *Store) SavedRemove(account, post int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("saved")).Delete(accountKey(account, post))
+	})
+}
+
+// SavedAll returns the posts account saved, newest first.
+func (s *Store) SavedAll(account int64) ([]*Post, error) {
+	_, m := s.postCacheGet()
+	res := make([]*Post, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("saved")).Cursor()
+		prefix := int64Bytes(account)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if post, ok := m[int64(binary.BigEndian.Uint64(k[8:]))]; ok {
+				p := *post
+				res = append(res, &p)
+			}
+		}
+		return nil
+	})
+	sort.Sort(postByDate(res))
+	return res, err
+}
+
+// SavedHas reports whether account saved post.
+func (s *Store) SavedHas(account, post int64) (bool, error) {
+	var res bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		res = tx.Bucket([]byte("saved")).Get(accountKey(account, post)) != nil
+		return nil
+	})
+	return res, err
+}
+
+// savedPosts returns the ids of all posts anybody saved.
+func savedPosts(tx *bolt.Tx) map[int64]bool {
+	res := make(map[int64]bool)
+	tx.Bucket([]byte("saved")).ForEach(func(k, v []byte) error {
+		res[int64(binary.BigEndian.Uint64(k[8:]))] = true
+		return nil
+	})
+	return res
+}
+
+// unsavePosts removes posts from the saved posts of all accounts.
+func unsavePosts(tx *bolt.Tx, posts map[int64]bool) error {
+	b := tx.Bucket([]byte("saved"))
+	remove := make([][]byte, 0)
+	b.ForEach(func(k, v []byte) error {
+		if posts[int64(binary.BigEndian.Uint64(k[8:]))] {
+			remove = append(remove, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, k := range remove {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
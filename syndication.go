@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexander-matz/go-news/db"
+	"github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Syndication
+ * A selection of feeds as Atom or RSS 2.0 document, /f/bbc+wik.atom or
+ * /f/bbc+wik.rss. With ?content=1 the readable version of every article that
+ * was extracted before is embedded.
+ */
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Author  *atomAuthor  `xml:"author,omitempty"`
+	Links   []atomLink   `xml:"link"`
+	Content *atomContent `xml:"content,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Content string     `xml:"xmlns:content,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title   string     `xml:"title"`
+	Link    string     `xml:"link"`
+	GUID    rssGUID    `xml:"guid"`
+	PubDate string     `xml:"pubDate"`
+	Source  *rssSource `xml:"source,omitempty"`
+	Encoded string     `xml:"content:encoded,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssSource struct {
+	URL   string `xml:"url,attr"`
+	Title string `xml:",chardata"`
+}
+
+// syndicationFormat splits the format extension off a feed selection.
+func syndicationFormat(selection string) (string, string) {
+	for _, format := range []string{"atom", "rss"} {
+		if strings.HasSuffix(selection, "."+format) {
+			return strings.TrimSuffix(selection, "."+format), format
+		}
+	}
+	return selection, ""
+}
+
+// absoluteURL turns a path of this site into an absolute url.
+func absoluteURL(c *gin.Context, path string) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host + path
+}
+
+// syndicationContent returns the readable versions of the posts by id. Only
+// articles extracted before are included, fetching them here would let every
+// request fan out into as many downloads as there are posts. The others are
+// left out, those of feeds with prefetching enabled are handed to the
+// prefetcher so they are there next time.
+func syndicationContent(posts []*Post, feeds map[int64]*Feed) map[int64]string {
+	res := make(map[int64]string)
+	missing := make([]*Post, 0)
+	for _, post := range posts {
+		r, err := articles.Stored(post)
+		if err == db.ErrNoContent {
+			if feed := feeds[post.Feed]; feed != nil && feed.Prefetch {
+				missing = append(missing, post)
+			}
+			continue
+		} else if err != nil {
+			logger.Printf("WARNING: no content for %s: %s", HashID(post.ID), err.Error())
+			continue
+		}
+		res[post.ID] = r.Content
+	}
+	if prefetcher != nil {
+		prefetcher.Enqueue(missing)
+	}
+	return res
+}
+
+// writeSyndication answers with the posts as document of the given format.
+// self is the path of the document, home the path of the html version.
+func writeSyndication(c *gin.Context, format, title, self, home string, posts []*Post, feeds map[int64]*Feed) {
+	var content map[int64]string
+	if c.Query("content") != "" && c.Query("content") != "0" {
+		content = syndicationContent(posts, feeds)
+	}
+	updated := time.Now()
+	if len(posts) > 0 {
+		updated = posts[0].Date
+	}
+	article := func(post *Post) string {
+		return absoluteURL(c, *serveBaseUrl+"/a/"+HashID(post.ID))
+	}
+
+	switch format {
+	case "atom":
+		doc := atomFeed{
+			Title:   title,
+			ID:      absoluteURL(c, self),
+			Updated: updated.Format(time.RFC3339),
+			Author:  atomAuthor{"go-news"},
+			Links: []atomLink{
+				{Href: absoluteURL(c, self), Rel: "self", Type: "application/atom+xml"},
+				{Href: absoluteURL(c, home), Rel: "alternate", Type: "text/html"},
+			},
+		}
+		for _, post := range posts {
+			entry := atomEntry{
+				Title:   post.Title,
+				ID:      article(post),
+				Updated: post.Date.Format(time.RFC3339),
+				Links:   []atomLink{{Href: post.Link, Rel: "alternate"}},
+			}
+			if feed, ok := feeds[post.Feed]; ok {
+				entry.Author = &atomAuthor{feed.Title}
+				if feed.Title == "" {
+					entry.Author.Name = feed.Handle
+				}
+			}
+			if body, ok := content[post.ID]; ok {
+				entry.Content = &atomContent{"html", body}
+			}
+			doc.Entries = append(doc.Entries, entry)
+		}
+		writeXML(c, "application/atom+xml; charset=utf-8", doc)
+	case "rss":
+		doc := rssDocument{
+			Version: "2.0",
+			Content: "http://purl.org/rss/1.0/modules/content/",
+			Channel: rssChannel{
+				Title:         title,
+				Link:          absoluteURL(c, home),
+				Description:   title,
+				LastBuildDate: updated.Format(time.RFC1123Z),
+			},
+		}
+		for _, post := range posts {
+			item := rssItem{
+				Title:   post.Title,
+				Link:    post.Link,
+				GUID:    rssGUID{false, article(post)},
+				PubDate: post.Date.Format(time.RFC1123Z),
+				Encoded: content[post.ID],
+			}
+			if feed, ok := feeds[post.Feed]; ok {
+				item.Source = &rssSource{feed.URL, feed.Title}
+			}
+			doc.Channel.Items = append(doc.Channel.Items, item)
+		}
+		writeXML(c, "application/rss+xml; charset=utf-8", doc)
+	}
+}
+
+func writeXML(c *gin.Context, contentType string, doc interface{}) {
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal error")
+		return
+	}
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
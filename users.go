@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * User pages
+ * Everyone with an account logs in at /u/login and picks the feeds shown on
+ * /f/ at /u/. Without subscriptions /f/ keeps showing all feeds.
+ */
+
+// subscribedFeeds returns the ids of the feeds the logged in user of the
+// request subscribed to, nil for anonymous users and users without
+// subscriptions.
+func subscribedFeeds(c *gin.Context) ([]int64, error) {
+	sess := currentSession(c)
+	if sess == nil || sess.Account == 0 {
+		return nil, nil
+	}
+	feeds, err := store.SubscriptionAll(sess.Account)
+	if err != nil || len(feeds) == 0 {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+func registerUser(r *gin.Engine, url func(string) string) {
+	// loginNext is where to go after logging in, only pages of this site are
+	// accepted
+	loginNext := func(c *gin.Context) string {
+		next := c.Query("next")
+		if next == "" {
+			next = c.PostForm("next")
+		}
+		if !strings.HasPrefix(next, url("/")) || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+			return url("/u/")
+		}
+		return next
+	}
+	done := func(c *gin.Context, msg string) {
+		c.Redirect(http.StatusSeeOther, url("/u/")+"?msg="+neturl.QueryEscape(msg))
+	}
+
+	r.GET(url("/u/login"), func(c *gin.Context) {
+		c.HTML(200, "login.tmpl", gin.H{"token": *serveAdminToken != "", "next": loginNext(c)})
+	})
+	r.POST(url("/u/login"), func(c *gin.Context) {
+		next := loginNext(c)
+		account, err := authenticate(store, strings.TrimSpace(c.PostForm("name")), c.PostForm("password"))
+		if err == ErrLogin {
+			c.HTML(200, "login.tmpl", gin.H{"token": *serveAdminToken != "", "next": next, "error": err.Error()})
+			return
+		} else if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		if err = login(c, account); err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, next)
+	})
+
+	user := r.Group(url("/u"), requireUser(url("/u/login")))
+
+	user.POST("/logout", func(c *gin.Context) {
+		logout(c)
+		c.Redirect(http.StatusSeeOther, url("/"))
+	})
+
+	user.GET("/", func(c *gin.Context) {
+		sess := c.MustGet("session").(*Session)
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		subscribed := make(map[int64]bool)
+		if sess.Account != 0 {
+			ids, err := store.SubscriptionAll(sess.Account)
+			if err != nil {
+				c.String(200, "Internal error")
+				return
+			}
+			for _, id := range ids {
+				subscribed[id] = true
+			}
+		}
+		c.HTML(200, "user.tmpl", gin.H{
+			"session":    sess,
+			"msg":        c.Query("msg"),
+			"feeds":      feeds,
+			"subscribed": subscribed,
+		})
+	})
+
+	user.POST("/subscriptions", func(c *gin.Context) {
+		sess := c.MustGet("session").(*Session)
+		if sess.Account == 0 {
+			done(c, "the admin token has no subscriptions, log in with an account")
+			return
+		}
+		feeds, err := store.FeedAll()
+		if err != nil {
+			c.String(200, "Internal error")
+			return
+		}
+		wanted := make(map[string]bool)
+		for _, handle := range c.PostFormArray("feed") {
+			wanted[handle] = true
+		}
+		selected := make([]int64, 0)
+		for _, feed := range feeds {
+			if wanted[feed.Handle] {
+				selected = append(selected, feed.ID)
+			}
+		}
+		if err := store.SubscriptionSet(sess.Account, selected); err != nil {
+			done(c, "unable to save subscriptions: "+err.Error())
+			return
+		}
+		if len(selected) == 0 {
+			done(c, "no subscriptions, /f/ shows all feeds")
+			return
+		}
+		done(c, "subscriptions saved")
+	})
+}
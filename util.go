@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"github.com/speps/go-hashids"
 	"log"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -35,6 +39,13 @@ func NewPrefixedLogger(prefix string) *log.Logger {
  * Auxiliary
  */
 
+// posts older than this are trimmed
+const postsHold = time.Hour * 24 * 2
+
+func PostsMaxAge() time.Time {
+	return time.Now().Add(postsHold * -1)
+}
+
 var urlre *regexp.Regexp
 
 func ValidateURL(url string) bool {
@@ -77,6 +88,96 @@ func DurationToHuman(d time.Duration) string {
 	return tmp
 }
 
+/******************************************************************************
+ * Post identity
+ * Posts are identified by the id the feed gives them (<guid> or Atom <id>).
+ * Feeds without ids are identified by their normalized link. Additionally
+ * every post has a fingerprint of its content to catch feeds that change
+ * ids on every fetch.
+ */
+
+// query parameters that only track where a click came from
+var trackingParams = map[string]bool{
+	"fbclid":      true,
+	"gclid":       true,
+	"dclid":       true,
+	"msclkid":     true,
+	"yclid":       true,
+	"igshid":      true,
+	"mc_cid":      true,
+	"mc_eid":      true,
+	"_ga":         true,
+	"ocid":        true,
+	"cmpid":       true,
+	"ns_mchannel": true,
+	"ns_source":   true,
+	"ns_campaign": true,
+	"ns_linkname": true,
+	"ns_fee":      true,
+}
+
+// NormalizeLink strips tracking parameters and other noise from a link so
+// that the same article linked with different campaign tags compares equal.
+func NormalizeLink(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return strings.TrimSpace(link)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) ||
+		(u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	query := u.Query()
+	for key := range query {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") || trackingParams[strings.ToLower(key)] {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+	// fragments like #at_medium=RSS are tracking as well, plain anchors are kept
+	if strings.Contains(u.Fragment, "=") {
+		u.Fragment = ""
+	}
+	return u.String()
+}
+
+// PostGUID returns the identity of a feed item given its id and link.
+func PostGUID(id, link, fingerprint string) string {
+	id = strings.TrimSpace(id)
+	if id != "" && id != strings.TrimSpace(link) {
+		return id
+	}
+	if link != "" {
+		return NormalizeLink(link)
+	}
+	return "sha1:" + fingerprint
+}
+
+// PostFingerprint hashes the parts of a feed item a reader would recognize
+// it by. It returns an empty string if there is nothing to hash.
+func PostFingerprint(title, link, content string) string {
+	title = strings.ToLower(strings.Join(strings.Fields(title), " "))
+	content = strings.Join(strings.Fields(content), " ")
+	if title == "" && content == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(title + "\n" + NormalizeLink(link) + "\n" + content))
+	return hex.EncodeToString(sum[:])
+}
+
+// PostKeys returns all keys a post is deduplicated by. Guids are only unique
+// within their feed, the fingerprint also catches the same item appearing in
+// several feeds.
+func PostKeys(p *Post) []string {
+	keys := []string{strconv.FormatInt(p.Feed, 10) + ":" + p.GUID}
+	if p.Fingerprint != "" {
+		keys = append(keys, "fp:"+p.Fingerprint)
+	}
+	return keys
+}
+
 var hidd *hashids.HashIDData
 var hid *hashids.HashID
 